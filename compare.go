@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"slices"
+
+	"pkg.i-no.de/pkg/d2hl/dedup"
+)
+
+// readReport reads a report written by writeReport.
+func readReport(path string) ([]dedup.Group, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rgs []reportGroup
+	if err := json.Unmarshal(data, &rgs); err != nil {
+		return nil, err
+	}
+	groups := make([]dedup.Group, 0, len(rgs))
+	for _, rg := range rgs {
+		groups = append(groups, rg.group())
+	}
+	return groups, nil
+}
+
+// groupSizes returns the number of files in each group, keyed by
+// algorithm and hash. Groups split up because of link limits are counted
+// together.
+func groupSizes(groups []dedup.Group) map[string]int {
+	sizes := make(map[string]int)
+	for _, g := range groups {
+		sizes[g.Algorithm+":"+g.Hash] += len(g.Linked) + 1
+	}
+	return sizes
+}
+
+// compareReports logs how the groups of a run differ from those of an
+// earlier one: which are new, which are gone, and which have changed in
+// size.
+func compareReports(logger *slog.Logger, old, cur []dedup.Group) {
+	before, after := groupSizes(old), groupSizes(cur)
+	var added, removed, changed int
+	keys := make([]string, 0, len(after))
+	for key := range after {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		n, ok := before[key]
+		switch {
+		case !ok:
+			logger.Info("New group", "hash", key, "files", after[key])
+			added++
+		case n != after[key]:
+			logger.Info("Group changed", "hash", key, "files", after[key], "before", n)
+			changed++
+		}
+	}
+	keys = keys[:0]
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		logger.Info("Group gone", "hash", key, "files", before[key])
+		removed++
+	}
+	logger.Info("Compared with earlier report", "new", added, "gone", removed, "changed", changed,
+		"unchanged", len(after)-added-changed)
+}
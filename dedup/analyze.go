@@ -0,0 +1,116 @@
+package dedup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/dustin/go-humanize"
+)
+
+// dupeSet is one group of identical files, before any linking.
+type dupeSet struct {
+	path   string
+	files  int
+	size   int64
+	wasted uint64
+}
+
+// dupeSets returns the groups of identical files and the total space
+// taken up by redundant copies. Like in dedupeDevices, groups are split
+// by device, since only files on the same one can be linked, unless the
+// files on the other devices would be replaced with symlinks.
+func (ti *treeinfo) dupeSets() ([]dupeSet, uint64, error) {
+	var sets []dupeSet
+	var total uint64
+	err := ti.Sums.groups(func(sum string, names []string) error {
+		if len(names) <= 1 {
+			return nil
+		}
+		if err := ti.ctx.Err(); err != nil {
+			return err
+		}
+		members := make([]string, 0, len(names))
+		stats := make([]fileMeta, 0, len(names))
+		for _, name := range names {
+			fi, err := os.Stat(name)
+			if err != nil {
+				ti.log.Warn("Could not stat file, leaving it out", "path", name, "error", err)
+				continue
+			}
+			st, err := statFile(name, fi)
+			if err != nil {
+				ti.log.Warn("Could not stat file, leaving it out", "path", name, "error", err)
+				continue
+			}
+			members = append(members, name)
+			stats = append(stats, st)
+		}
+		parts, partstats := split(members, stats, func(_ string, st fileMeta) uint64 { return st.ID.Dev })
+		if ti.symlinkKeep(sum, partstats) >= 0 {
+			parts, partstats = [][]string{members}, [][]fileMeta{stats}
+		}
+		for i, part := range parts {
+			if len(part) <= 1 {
+				continue
+			}
+			size := partstats[i][0].Size
+			//nolint:gosec // File sizes are never negative
+			wasted := uint64(len(part)-1) * uint64(size)
+			sets = append(sets, dupeSet{path: part[0], files: len(part), size: size, wasted: wasted})
+			total += wasted
+		}
+		return nil
+	})
+	return sets, total, err
+}
+
+// analyze logs how much space is taken up by duplicates, how large the
+// groups of duplicates are, and the groups wasting the most space. It is
+// used instead of dedupe by Config.Analyze and does not touch any files.
+func (ti *treeinfo) analyze() error {
+	sets, total, err := ti.dupeSets()
+	if err != nil {
+		return err
+	}
+	ti.log.Info("Duplication analysis", "sets", len(sets), "redundant", humanize.Bytes(total))
+
+	// Bucket group sizes by powers of two: 2, 3-4, 5-8 and so on.
+	var buckets []int
+	for _, s := range sets {
+		b := 0
+		for limit := 2; s.files > limit; limit *= 2 {
+			b++
+		}
+		for len(buckets) <= b {
+			buckets = append(buckets, 0)
+		}
+		buckets[b]++
+	}
+	lo := 2
+	for b, n := range buckets {
+		hi := 2 << b
+		files := fmt.Sprintf("%d-%d", lo, hi)
+		if lo == hi {
+			files = fmt.Sprint(lo)
+		}
+		lo = hi + 1
+		if n == 0 {
+			continue
+		}
+		ti.log.Info("Group size histogram", "files", files, "sets", n)
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].wasted > sets[j].wasted
+	})
+	if len(sets) > ti.cfg.AnalyzeTop {
+		sets = sets[:max(ti.cfg.AnalyzeTop, 0)]
+	}
+	for i, s := range sets {
+		//nolint:gosec // File sizes are never negative
+		ti.log.Info("Most wasted space", "rank", i+1, "path", s.path, "files", s.files,
+			"size", humanize.Bytes(uint64(s.size)), "wasted", humanize.Bytes(s.wasted))
+	}
+	return nil
+}
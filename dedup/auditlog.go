@@ -0,0 +1,45 @@
+package dedup
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog appends a line of JSON for each link made (or, in dry runs,
+// that would be made) to a file. The file is written to without
+// buffering, so the record survives the process being killed. It is safe
+// for concurrent use by the dedupe workers.
+type auditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+type auditEntry struct {
+	Time   time.Time `json:"timestamp"`
+	Src    string    `json:"src"`
+	Dest   string    `json:"dest"`
+	Size   int64     `json:"size"`
+	DryRun bool      `json:"dryrun"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// add records that src was (or would be) replaced by a link to dest.
+func (a *auditLog) add(src, dest string, size int64, dryrun bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enc.Encode(auditEntry{Time: time.Now(), Src: src, Dest: dest, Size: size, DryRun: dryrun})
+}
+
+func (a *auditLog) close() error {
+	return a.f.Close()
+}
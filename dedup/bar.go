@@ -0,0 +1,75 @@
+package dedup
+
+import (
+	"log/slog"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// barReporter owns a progress bar and is the only goroutine updating it.
+// Workers send their increments on a buffered channel instead, so they do
+// not contend for the bar's lock. A nil *barReporter discards updates.
+type barReporter struct {
+	bar  *progressbar.ProgressBar
+	ch   chan int64
+	done chan struct{}
+	log  *slog.Logger
+}
+
+func newBarReporter(bar *progressbar.ProgressBar, log *slog.Logger) *barReporter {
+	b := &barReporter{bar: bar, ch: make(chan int64, 256), done: make(chan struct{}), log: log}
+	go b.run()
+	return b
+}
+
+// run applies the increments until the channel is closed. If the bar
+// cannot be updated, that is logged once, since progress bars are not
+// worth failing the run for.
+func (b *barReporter) run() {
+	defer close(b.done)
+	failed := false
+	for n := range b.ch {
+		if failed {
+			continue
+		}
+		if err := b.bar.Add64(n); err != nil {
+			b.log.Warn("Could not update progress bar", "error", err)
+			failed = true
+		}
+	}
+}
+
+// add advances the bar by n.
+func (b *barReporter) add(n int64) {
+	if b == nil {
+		return
+	}
+	b.ch <- n
+}
+
+// close waits for all increments to be applied. add must not be called
+// after it.
+func (b *barReporter) close() {
+	if b == nil {
+		return
+	}
+	close(b.ch)
+	<-b.done
+}
+
+// newBar returns a progress bar for total items, or nil if progress bars
+// are disabled or replaced by Config.ProgressFunc.
+func (ti *treeinfo) newBar(total int, desc string) *barReporter {
+	if !ti.cfg.Progress || ti.cfg.ProgressFunc != nil {
+		return nil
+	}
+	return newBarReporter(progressbar.Default(int64(total), desc), ti.log)
+}
+
+// newByteBar is like newBar, but counts and shows bytes.
+func (ti *treeinfo) newByteBar(total int64, desc string) *barReporter {
+	if !ti.cfg.Progress || ti.cfg.ProgressFunc != nil {
+		return nil
+	}
+	return newBarReporter(progressbar.DefaultBytes(total, desc), ti.log)
+}
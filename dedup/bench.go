@@ -0,0 +1,51 @@
+package dedup
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// BenchResult is the checksum throughput measured with one number of
+// jobs, see Config.Bench.
+type BenchResult struct {
+	Jobs     int
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// bench checksums all files found once for each of Config.Bench's job
+// counts, without using the hash cache or modifying anything.
+func (ti *treeinfo) bench() ([]BenchResult, error) {
+	var paths []string
+	for key, ps := range ti.SizeGroups {
+		paths = append(paths, ps...)
+		if key.Size == compressedSize {
+			continue
+		}
+		for _, path := range ps {
+			ti.Sizes[path] = key.Size
+		}
+	}
+	ti.cache = nil
+	ti.log.Info("Benchmarking checksumming", "files", len(paths), "jobs", ti.cfg.Bench)
+	var results []BenchResult
+	for _, jobs := range ti.cfg.Bench {
+		ti.cfg.Jobs = jobs
+		ti.Unreadable = nil
+		start := time.Now()
+		if err := ti.hashFiles(paths, 0, fmt.Sprintf("Bench/%d", jobs), memStore{}); err != nil {
+			return results, err
+		}
+		elapsed := time.Since(start)
+		bytes := ti.prog.bytes.Load()
+		//nolint:gosec // Byte counts are never negative
+		ti.log.Info("Benchmark round done", "jobs", jobs, "bytes", humanize.Bytes(uint64(bytes)), "time", elapsed,
+			"mb_per_sec", perSec(float64(bytes)/1e6, elapsed))
+		results = append(results, BenchResult{Jobs: jobs, Files: len(paths) - len(ti.Unreadable), Bytes: bytes,
+			Duration: elapsed})
+	}
+	return results, nil
+}
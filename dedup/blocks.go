@@ -0,0 +1,153 @@
+package dedup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// BlockReport is the result of Config.BlockReport.
+type BlockReport struct {
+	BlockSize int64
+	// Blocks is the number of full blocks in all files, of which Unique
+	// are distinct and Zero consist of zero bytes only.
+	Blocks int64
+	Unique int64
+	Zero   int64
+}
+
+// blockKey is the part of a block's checksum that is kept, to save
+// memory. A collision merely makes the report a little optimistic.
+type blockKey [16]byte
+
+// blockReport checksums all files found in blocks of Config.BlockReport
+// bytes, and reports how many of them are duplicates. Files are only
+// read, using Config.Jobs workers like hashFiles.
+func (ti *treeinfo) blockReport() (*BlockReport, error) {
+	var paths []string
+	var total int64
+	for key, ps := range ti.SizeGroups {
+		paths = append(paths, ps...)
+		if key.Size != compressedSize {
+			total += key.Size * int64(len(ps))
+			continue
+		}
+		for _, path := range ps {
+			total += ti.Sizes[path]
+		}
+	}
+	bs := ti.cfg.BlockReport
+	ti.log.Info("Checksumming blocks", "files", len(paths), "blocksize", bs)
+	ti.prog.setPhase("blocks", len(paths))
+	ti.progbar = ti.newByteBar(total, "Blocks")
+	start := time.Now()
+	seen := make(map[blockKey]bool)
+	rep := &BlockReport{BlockSize: bs}
+	var mu sync.Mutex
+	// add records the blocks of one file, to take the lock once per file.
+	add := func(keys []blockKey, zero int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		rep.Blocks += int64(len(keys)) + zero
+		rep.Zero += zero
+		for _, k := range keys {
+			if !seen[k] {
+				seen[k] = true
+				rep.Unique++
+			}
+		}
+	}
+	c := make(chan string)
+	var wg sync.WaitGroup
+	var hashErr error
+	for range ti.cfg.Jobs {
+		h, err := newHash(ti.cfg.Hash)
+		if err != nil {
+			hashErr = err
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bs)
+			zeros := make([]byte, bs)
+			for path := range c {
+				ti.prog.done.Add(1)
+				var keys []blockKey
+				var zero int64
+				err := ti.readBlocks(path, buf, func(block []byte) {
+					if bytes.Equal(block, zeros) {
+						zero++
+						return
+					}
+					h.Reset()
+					h.Write(block)
+					var k blockKey
+					copy(k[:], h.Sum(nil))
+					keys = append(keys, k)
+				})
+				if err != nil {
+					if ti.ctx.Err() == nil {
+						ti.log.Warn("Could not read file", "path", path, "err", err)
+					}
+					continue
+				}
+				add(keys, zero)
+			}
+		}()
+	}
+	err := hashErr
+dispatch:
+	for _, path := range paths {
+		if err != nil {
+			break
+		}
+		select {
+		case c <- path:
+		case <-ti.ctx.Done():
+			err = ti.ctx.Err()
+			break dispatch
+		}
+	}
+	close(c)
+	wg.Wait()
+	ti.progbar.close()
+	if err != nil {
+		return rep, err
+	}
+	elapsed := time.Since(start)
+	shared := rep.Blocks - rep.Unique - rep.Zero
+	//nolint:gosec // Block counts and sizes are never negative
+	ti.log.Info("Block report", "blocksize", bs, "blocks", rep.Blocks, "unique", rep.Unique, "zero", rep.Zero,
+		"shared_blocks", shared, "shared_bytes", humanize.Bytes(uint64(shared*bs)),
+		"zero_bytes", humanize.Bytes(uint64(rep.Zero*bs)), "time", elapsed)
+	return rep, nil
+}
+
+// readBlocks calls fn for each full block of the file at path, read into
+// buf. A partial block at the end of the file is skipped.
+func (ti *treeinfo) readBlocks(path string, buf []byte, fn func([]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := ti.reader(f)
+	for {
+		n, err := io.ReadFull(r, buf)
+		ti.prog.bytes.Add(int64(n))
+		ti.progbar.add(int64(n))
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(buf)
+	}
+}
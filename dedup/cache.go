@@ -0,0 +1,215 @@
+package dedup
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"unicode/utf8"
+
+	"pkg.i-no.de/pkg/d2hl/internal/atomicfile"
+)
+
+// cacheVersion is the version of the cache format written by save.
+// Caches of other versions are ignored.
+const cacheVersion = 2
+
+// cacheKey identifies the contents of a file: the same i-node with the
+// same size and mtime is assumed to hold the same data, whatever path it
+// is found under, e.g. in bind mounts or after a rename.
+type cacheKey struct {
+	Dev   uint64
+	Ino   uint64
+	Size  int64
+	Mtime int64
+}
+
+// cacheEntry is the checksum of a file, along with the metadata used to
+// tell whether the file has changed since, and the path it was last seen
+// under.
+type cacheEntry struct {
+	Dev   uint64 `json:"dev"`
+	Ino   uint64 `json:"ino"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	Path  string `json:"path"`
+	Sum   string `json:"sum"`
+}
+
+// plainEntry is cacheEntry without its JSON methods.
+type plainEntry cacheEntry
+
+// jsonEntry is the JSON form of a cacheEntry, which keeps paths that are
+// not valid UTF-8 like jsonFile does.
+type jsonEntry struct {
+	plainEntry
+	RawPath []byte `json:"path_b64,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e cacheEntry) MarshalJSON() ([]byte, error) {
+	v := jsonEntry{plainEntry: plainEntry(e)}
+	if !utf8.ValidString(e.Path) {
+		v.RawPath = []byte(e.Path)
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *cacheEntry) UnmarshalJSON(data []byte) error {
+	var v jsonEntry
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = cacheEntry(v.plainEntry)
+	if v.RawPath != nil {
+		e.Path = string(v.RawPath)
+	}
+	return nil
+}
+
+func (e cacheEntry) key() cacheKey {
+	return cacheKey{Dev: e.Dev, Ino: e.Ino, Size: e.Size, Mtime: e.Mtime}
+}
+
+// cacheFile is the on-disk format of the hash cache.
+type cacheFile struct {
+	Version   int          `json:"version"`
+	Algorithm string       `json:"algorithm"`
+	Entries   []cacheEntry `json:"entries"`
+}
+
+// hashCache keeps checksums across runs, keyed by i-node, size and mtime.
+// It is safe for concurrent use by the checksum workers.
+type hashCache struct {
+	mu      sync.Mutex
+	path    string
+	algo    string
+	entries map[cacheKey]cacheEntry
+	used    map[cacheKey]bool
+	hits    int
+	updates int
+}
+
+// loadCache reads the hash cache at path. A missing cache, or one made
+// with a different checksum algorithm or format, results in an empty
+// cache.
+func (ti *treeinfo) loadCache(path string) (*hashCache, error) {
+	c := &hashCache{
+		path:    path,
+		algo:    ti.cfg.Hash,
+		entries: make(map[cacheKey]cacheEntry),
+		used:    make(map[cacheKey]bool),
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Older caches have no version, and their entries do not decode.
+	var header struct {
+		Version   int    `json:"version"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+	if header.Version != cacheVersion {
+		ti.log.Info("Hash cache has a different format, ignoring it", "path", path,
+			"version", header.Version, "want", cacheVersion)
+		return c, nil
+	}
+	if header.Algorithm != ti.cfg.Hash {
+		ti.log.Info("Hash cache uses a different algorithm, ignoring it", "path", path,
+			"cached", header.Algorithm, "hash", ti.cfg.Hash)
+		return c, nil
+	}
+	var data cacheFile
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	for _, e := range data.Entries {
+		c.entries[e.key()] = e
+	}
+	ti.log.Debug("Loaded hash cache", "path", path, "entries", len(c.entries))
+	return c, nil
+}
+
+// cacheKeyOf returns the cache key for the file at path, described by
+// info. It fails where files have no i-node numbers.
+func cacheKeyOf(path string, info fs.FileInfo) (cacheKey, error) {
+	meta, err := statFile(path, info)
+	if err != nil {
+		return cacheKey{}, err
+	}
+	return cacheKey{Dev: meta.ID.Dev, Ino: meta.ID.Ino, Size: info.Size(), Mtime: info.ModTime().UnixNano()}, nil
+}
+
+// lookup returns the cached checksum for the file at path, if its i-node
+// has not changed since it was cached, under this path or another.
+func (c *hashCache) lookup(path string, info fs.FileInfo) (string, bool) {
+	key, err := cacheKeyOf(path, info)
+	if err != nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.Sum == "" {
+		return "", false
+	}
+	// Remember where the file was seen last, for pruning in save.
+	e.Path = path
+	c.entries[key] = e
+	c.used[key] = true
+	c.hits++
+	return e.Sum, true
+}
+
+func (c *hashCache) store(path string, info fs.FileInfo, sum string) {
+	key, err := cacheKeyOf(path, info)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{Dev: key.Dev, Ino: key.Ino, Size: key.Size, Mtime: key.Mtime, Path: path, Sum: sum}
+	c.used[key] = true
+	c.updates++
+}
+
+// save writes the cache back to disk. Entries not used by this run are
+// dropped if the file they were last seen as no longer exists or has
+// changed, since they cannot match again.
+func (c *hashCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data := cacheFile{Version: cacheVersion, Algorithm: c.algo, Entries: []cacheEntry{}}
+	for key, e := range c.entries {
+		if !c.used[key] {
+			fi, err := os.Stat(e.Path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err == nil {
+				if now, err := cacheKeyOf(e.Path, fi); err == nil && now != key {
+					continue
+				}
+			}
+		}
+		data.Entries = append(data.Entries, e)
+	}
+	slices.SortFunc(data.Entries, func(a, b cacheEntry) int {
+		return cmp.Or(cmp.Compare(a.Dev, b.Dev), cmp.Compare(a.Ino, b.Ino), cmp.Compare(a.Mtime, b.Mtime))
+	})
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(c.path, raw)
+}
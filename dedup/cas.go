@@ -0,0 +1,105 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contentHash returns the hex checksum for a Sums key, hashing the
+// contents kept in raw keys.
+func (ti *treeinfo) contentHash(sum string) (string, error) {
+	raw, ok := strings.CutPrefix(sum, rawPrefix)
+	if !ok {
+		return sum, nil
+	}
+	h, err := newHash(ti.cfg.Hash)
+	if err != nil {
+		return "", err
+	}
+	h.Write([]byte(raw))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// storeTarget makes the file for the group with the given sum in
+// Config.Store the group's link target. It is added to names and stats
+// unless it is a member already, and created as a link to the member at
+// index target if it does not exist yet. An existing store file is only
+// used if its contents match. It returns the new names, stats and target
+// index, or ok false if the group is to be skipped.
+func (ti *treeinfo) storeTarget(sum string, names []string, stats []fileMeta, target int) (_ []string, _ []fileMeta, _ int, ok bool, _ error) {
+	hash, err := ti.contentHash(sum)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	path := filepath.Join(ti.cfg.Store, hash[:2], hash)
+	for i, name := range names {
+		if filepath.Clean(name) == path {
+			return names, stats, i, true, nil
+		}
+	}
+	fi, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if ti.cfg.DryRun {
+			ti.log.Info("Would add file to store", "src", names[target], "dest", path)
+			ti.RWLock.Lock()
+			ti.storeSources[path] = names[target]
+			ti.RWLock.Unlock()
+			return append([]string{path}, names...), append([]fileMeta{stats[target]}, stats...), 0, true, nil
+		}
+		ti.log.Info("Adding file to store", "src", names[target], "dest", path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, nil, 0, false, fmt.Errorf("could not create store directory: %w", err)
+		}
+		if err := os.Link(names[target], path); err != nil {
+			ti.log.Warn("Could not add file to store, skipping group", "src", names[target], "dest", path,
+				"error", err)
+			return nil, nil, 0, false, nil
+		}
+		fi, err = os.Stat(path)
+		if err != nil {
+			return nil, nil, 0, false, err
+		}
+	case err != nil:
+		return nil, nil, 0, false, fmt.Errorf("could not stat store file: %w", err)
+	default:
+		same, err := sameContents(path, names[target])
+		if err != nil {
+			return nil, nil, 0, false, err
+		}
+		if !same {
+			ti.log.Error("Store file differs from group with the same checksum, skipping group", "path", path,
+				"member", names[target])
+			ti.RWLock.Lock()
+			ti.HashCollisions++
+			ti.RWLock.Unlock()
+			return nil, nil, 0, false, nil
+		}
+	}
+	st, err := statFile(path, fi)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	return append([]string{path}, names...), append([]fileMeta{st}, stats...), 0, true, nil
+}
+
+// storeSingle links a file without duplicates among the files found to
+// its file in Config.Store, or adds it to the store if there is none
+// yet, see storeTarget.
+func (ti *treeinfo) storeSingle(sum, name string, st fileMeta) (uint64, error) {
+	names, stats, target, ok, err := ti.storeTarget(sum, []string{name}, []fileMeta{st}, 0)
+	if !ok || err != nil {
+		return 0, err
+	}
+	// A file just added to the store is linked to it already, and only
+	// one found there can be filtered like other groups.
+	//nolint:gosec // File sizes are never negative
+	if stats[target].ID != st.ID && ti.skipGroup(names, stats, target, uint64(st.Size)) {
+		return 0, nil
+	}
+	return ti.linkGroup(sum, names, stats, target)
+}
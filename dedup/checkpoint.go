@@ -0,0 +1,65 @@
+package dedup
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// checkpoint records which groups have been fully linked, so an
+// interrupted run can skip them when restarted. It is safe for concurrent
+// use by the dedupe workers.
+type checkpoint struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	done map[string]bool
+}
+
+// openCheckpoint reads the groups recorded in the checkpoint file at path,
+// if it exists, and opens it for recording more.
+func openCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{path: path, done: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			c.done[line] = true
+		}
+	}
+	c.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// has reports whether the group with the given key was recorded by an
+// earlier run.
+func (c *checkpoint) has(key string) bool {
+	return c.done[key]
+}
+
+// add records the group with the given key as done.
+func (c *checkpoint) add(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.f.WriteString(key + "\n")
+	return err
+}
+
+// close closes the checkpoint file, and removes it if the run completed,
+// since its groups might gain new members before the next run.
+func (c *checkpoint) close(completed bool) error {
+	err := c.f.Close()
+	if completed {
+		if rerr := os.Remove(c.path); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+package dedup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// hashFiles checksums paths using Config.Jobs workers and adds them to
+// sums. If limit is non-zero, only the first limit bytes of each file are
+// hashed, and the file size is made part of the key. If the run is
+// canceled, files already being hashed are finished and the context's
+// error is returned.
+func (ti *treeinfo) hashFiles(paths []string, limit int64, desc string, sums sumStore) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	var addErr error
+	add := func(sum, path string, size int64) {
+		ti.RWLock.Lock()
+		defer ti.RWLock.Unlock()
+		ti.HashedSizes[path] = size
+		if addErr == nil {
+			addErr = sums.add(sum, path)
+		}
+	}
+	ti.prog.setPhase(strings.ToLower(desc), len(paths))
+	var total int64
+	for _, path := range paths {
+		total += ti.readSize(path, limit)
+	}
+	// Each worker reuses its own hasher and buffer for all of its files.
+	hashers := make([]*hasher, ti.cfg.Jobs)
+	for i := range hashers {
+		h, err := newHash(ti.cfg.Hash)
+		if err != nil {
+			return err
+		}
+		hashers[i] = &hasher{h: h, buf: make([]byte, ti.cfg.ReadBuffer)}
+	}
+	ti.progbar = ti.newByteBar(total, desc)
+	c := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < ti.cfg.Jobs; i++ {
+		go ti.checksum(i, limit, hashers[i], add, c, &wg)
+		wg.Add(1)
+	}
+	var err error
+dispatch:
+	for _, path := range paths {
+		select {
+		case c <- path:
+		case <-ti.ctx.Done():
+			err = ti.ctx.Err()
+			break dispatch
+		}
+	}
+	close(c)
+	wg.Wait()
+	ti.progbar.close()
+	if err != nil {
+		return err
+	}
+	return addErr
+}
+
+// hasher is the per-worker state for checksumming files.
+type hasher struct {
+	h   hash.Hash
+	buf []byte
+}
+
+func (ti *treeinfo) checksum(id int, limit int64, h *hasher, add func(sum, path string, size int64), p chan string, wg *sync.WaitGroup) {
+	wlog := ti.log.With("workerid", id)
+	wlog.Debug("Worker starting")
+	defer wg.Done()
+	for path := range p {
+		s, size, err := ti.sumFile(path, limit, h)
+		ti.prog.done.Add(1)
+		if err != nil {
+			if ti.ctx.Err() != nil {
+				// Only interrupted, hashFiles returns the context's error.
+				continue
+			}
+			wlog.Warn("Could not checksum file", "path", path, "err", err)
+			ti.RWLock.Lock()
+			ti.Unreadable = append(ti.Unreadable, path)
+			ti.RWLock.Unlock()
+			continue
+		}
+		sum, _ := ti.describeSum(s)
+		if ti.cfg.LogHashes {
+			ti.log.Info("Checksum", "path", path, "sum", sum)
+		} else {
+			wlog.Debug("Checksum", "path", path, "sum", sum)
+		}
+		add(s, path, size)
+		ti.progbar.add(ti.readSize(path, limit))
+	}
+	wlog.Debug("Worker exiting")
+}
+
+// readSize returns how many bytes of the file at path are read when
+// checksumming it with the given limit, based on its size when it was
+// enumerated.
+func (ti *treeinfo) readSize(path string, limit int64) int64 {
+	size := ti.Sizes[path]
+	if limit > 0 && size > limit {
+		return limit
+	}
+	return size
+}
+
+// rawPrefix marks Sums keys that are the file contents rather than a
+// checksum, see Config.SmallFile.
+const rawPrefix = "raw:"
+
+// decompPrefix marks Sums keys that are checksums of decompressed
+// contents, see Config.Decompress.
+const decompPrefix = "decompressed:"
+
+// compressed reports whether the file at path is checksummed by its
+// decompressed contents.
+func (ti *treeinfo) compressed(path string) bool {
+	return ti.cfg.Decompress && (strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zst"))
+}
+
+// decompressor returns a reader of the decompressed contents of r, which
+// is read from the file at path, and a function to release it.
+func decompressor(path string, r io.Reader) (io.Reader, func(), error) {
+	if strings.HasSuffix(path, ".zst") {
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return zr, func() {}, nil
+}
+
+// sumFile returns the key to group the file at path by. This is its
+// checksum, computed with h, or for files smaller than Config.SmallFile,
+// its contents. Compressed files are checksummed decompressed. It also
+// returns the file's size at the time, which dedupe checks again before
+// linking.
+func (ti *treeinfo) sumFile(path string, limit int64, h *hasher) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	size := fi.Size()
+	gz := ti.compressed(path)
+	if size < ti.cfg.SmallFile && !gz {
+		data, err := io.ReadAll(io.LimitReader(ti.reader(f), ti.cfg.SmallFile))
+		if err != nil {
+			return "", 0, err
+		}
+		if int64(len(data)) != size {
+			return "", 0, fmt.Errorf("file changed size while reading")
+		}
+		ti.prog.bytes.Add(size)
+		return rawPrefix + string(data), size, nil
+	}
+	usecache := ti.cache != nil && limit == 0 && !gz
+	if usecache {
+		if sum, ok := ti.cache.lookup(path, fi); ok {
+			return sum, size, nil
+		}
+	}
+	h.h.Reset()
+	prefix := ""
+	var n int64
+	mapped := false
+	// Mapped files are read all at once, which the throttle cannot limit.
+	if ti.cfg.Mmap && !gz && limit == 0 && ti.throttle == nil && size >= ti.cfg.MmapMin {
+		n, err = hashMapped(h.h, f, size)
+		mapped = err == nil
+		if !mapped {
+			ti.log.Debug("Could not map file, reading it instead", "path", path, "error", err)
+			h.h.Reset()
+		}
+	}
+	if !mapped {
+		r := ti.reader(f)
+		if gz {
+			zr, release, err := decompressor(path, r)
+			if err != nil {
+				return "", 0, fmt.Errorf("could not decompress file: %w", err)
+			}
+			defer release()
+			r = zr
+			prefix = decompPrefix
+		}
+		if limit > 0 {
+			if !gz {
+				// Different sizes may share a prefix, so keep them apart.
+				prefix = fmt.Sprintf("%d-", size)
+			}
+			r = io.LimitReader(r, limit)
+		}
+		// Hide any WriteTo method of r, which would not use our buffer.
+		n, err = io.CopyBuffer(h.h, struct{ io.Reader }{r}, h.buf)
+	}
+	ti.prog.bytes.Add(n)
+	if err != nil {
+		return "", 0, err
+	}
+	if limit == 0 && !gz && n != size {
+		return "", 0, fmt.Errorf("file changed size while reading")
+	}
+	sum := fmt.Sprintf("%s%x", prefix, h.h.Sum(nil))
+	if usecache {
+		ti.cache.store(path, fi, sum)
+	}
+	return sum, size, nil
+}
+
+// metaPrefix marks Sums keys that are a file's size and mtime, see
+// Config.TrustMtime.
+const metaPrefix = "meta:"
+
+// metaFiles adds paths to sums keyed by their size and mtime, for
+// Config.TrustMtime.
+func (ti *treeinfo) metaFiles(paths []string, sums sumStore) error {
+	ti.prog.setPhase("stat", len(paths))
+	for _, path := range paths {
+		if err := ti.ctx.Err(); err != nil {
+			return err
+		}
+		ti.prog.done.Add(1)
+		fi, err := os.Stat(path)
+		if err != nil {
+			ti.log.Warn("Could not stat file", "path", path, "err", err)
+			ti.Unreadable = append(ti.Unreadable, path)
+			continue
+		}
+		ti.HashedSizes[path] = fi.Size()
+		if err := sums.add(fmt.Sprintf("%s%d-%d", metaPrefix, fi.Size(), fi.ModTime().UnixNano()), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeSum returns the printable form of a Sums key and the name of
+// the algorithm that produced it.
+func (ti *treeinfo) describeSum(sum string) (string, string) {
+	if raw, ok := strings.CutPrefix(sum, rawPrefix); ok {
+		return fmt.Sprintf("%x", raw), "raw"
+	}
+	if decomp, ok := strings.CutPrefix(sum, decompPrefix); ok {
+		return decomp, "decompressed-" + ti.cfg.Hash
+	}
+	if meta, ok := strings.CutPrefix(sum, metaPrefix); ok {
+		return meta, "size-mtime"
+	}
+	return sum, ti.cfg.Hash
+}
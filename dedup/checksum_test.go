@@ -0,0 +1,104 @@
+package dedup
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchFile writes a file of size random bytes for the checksum
+// benchmarks and returns its path.
+func benchFile(b *testing.B, size int) string {
+	b.Helper()
+	data := make([]byte, size)
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	path := filepath.Join(b.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkSumFile checksums a small file with one hasher reused for all
+// files, as the checksum workers do, and with a new hasher for each.
+func BenchmarkSumFile(b *testing.B) {
+	path := benchFile(b, 4096)
+	ti := testTI(b, Config{})
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+		h, err := newHash(ti.cfg.Hash)
+		if err != nil {
+			b.Fatal(err)
+		}
+		hr := &hasher{h: h, buf: make([]byte, ti.cfg.ReadBuffer)}
+		for range b.N {
+			if _, _, err := ti.sumFile(path, 0, hr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, ti.cfg.ReadBuffer)
+		for range b.N {
+			h, err := newHash(ti.cfg.Hash)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := ti.sumFile(path, 0, &hasher{h: h, buf: buf}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkReadBuffer checksums a 64MiB file through read buffers of
+// different sizes, see Config.ReadBuffer.
+func BenchmarkReadBuffer(b *testing.B) {
+	const size = 64 << 20
+	path := benchFile(b, size)
+	for _, bufsize := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", bufsize>>10), func(b *testing.B) {
+			ti := testTI(b, Config{ReadBuffer: bufsize})
+			h, err := newHash(ti.cfg.Hash)
+			if err != nil {
+				b.Fatal(err)
+			}
+			hr := &hasher{h: h, buf: make([]byte, bufsize)}
+			b.SetBytes(size)
+			for range b.N {
+				if _, _, err := ti.sumFile(path, 0, hr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMmap checksums a 64MiB file by reading it and, with
+// Config.Mmap, by mapping it. Where mmap is not supported, both read it.
+func BenchmarkMmap(b *testing.B) {
+	const size = 64 << 20
+	path := benchFile(b, size)
+	for _, mmap := range []bool{false, true} {
+		b.Run(map[bool]string{false: "read", true: "mmap"}[mmap], func(b *testing.B) {
+			ti := testTI(b, Config{Mmap: mmap})
+			h, err := newHash(ti.cfg.Hash)
+			if err != nil {
+				b.Fatal(err)
+			}
+			hr := &hasher{h: h, buf: make([]byte, ti.cfg.ReadBuffer)}
+			b.SetBytes(size)
+			for range b.N {
+				if _, _, err := ti.sumFile(path, 0, hr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,1119 @@
+// Copyright 2020 Tobias Klausmann
+// License: Apache 2.0, see LICENSE for details
+
+// Package dedup finds files with identical contents and replaces the
+// duplicates with hard links to a single copy.
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"pkg.i-no.de/pkg/d2hl/internal/atomicfile"
+)
+
+// Config controls a deduplication run.
+type Config struct {
+	// Roots are the directories to walk. Defaults to the current directory,
+	// unless Files is set.
+	Roots []string
+	// Files, if non-nil, are the candidate files, and no directories are
+	// walked. They are filtered like the files found by walking.
+	Files []string
+	// LinkPairs, if non-nil, are pairs of files that should be links of
+	// each other. Instead of looking for duplicates, Run only checks them,
+	// and links those that are not, but have the same contents. Roots and
+	// Files are ignored.
+	LinkPairs [][2]string
+	// ExportPlan, if set, is a file to which the groups a dry run would
+	// link are written, along with the size, mtime and i-node of each
+	// file, for ApplyPlan. With Store, a group whose store file does not
+	// exist yet has the file it would be made from as the target.
+	ExportPlan string
+	// ApplyPlan, if set, is a plan written by ExportPlan. Instead of
+	// looking for duplicates, Run links the groups in it, always to the
+	// plan's target, regardless of Keep and Prefer. Files that have
+	// changed since the plan was made are skipped, as are groups whose
+	// target has changed. Roots and Files are ignored.
+	ApplyPlan string
+	// Jobs is the number of parallel checksum and dedupe workers.
+	// Defaults to the number of CPUs, and must not be negative.
+	Jobs int
+	// Walkers is the number of directories read concurrently while
+	// enumerating files. Values below two walk the tree serially.
+	Walkers int
+	// MaxDepth, if positive, limits the walk to directories less than
+	// MaxDepth levels below a root, so 1 only considers the files in the
+	// roots themselves. Directories reached through a symlink count from
+	// the level of the symlink.
+	MaxDepth int
+	// FollowSymlinks descends into symlinked directories and adds
+	// symlinked regular files under their resolved path. Directories are
+	// only walked once, so symlink loops are harmless.
+	FollowSymlinks bool
+	// ListDevices only logs the devices the candidate files are on, and
+	// how many files and bytes are on each, after enumerating them.
+	ListDevices bool
+	// ListCandidates only enumerates files, and returns those that would
+	// be checksummed in Result.Candidates.
+	ListCandidates bool
+	// Bench, if not empty, only checksums all files found once with each
+	// of the given numbers of jobs, and returns the throughput in
+	// Result.Bench. The page cache is likely to speed up all but the first
+	// round, unless the files do not fit into it.
+	Bench []int
+	// BlockReport, if non-zero, only checksums all files found in blocks
+	// of this many bytes, and returns how many of the blocks are
+	// duplicates in Result.BlockReport. This is the space that could be
+	// saved by sharing blocks instead of whole files, e.g. with reflinks.
+	// All distinct blocks are kept in memory. It must be a power of two
+	// no larger than MaxBlockReport.
+	BlockReport int64
+	// Analyze only reports how much space duplicates take up, how large
+	// the groups of duplicates are and which waste the most space. It
+	// does not modify any files, nor log individual actions.
+	Analyze bool
+	// AnalyzeTop is the number of groups listed by Analyze.
+	AnalyzeTop int
+	// Confirm, if set, is called before any files are modified, with the
+	// number of files that are about to be linked and the space that
+	// would be freed. Like the links, both only count duplicates on the
+	// same device, unless files on other devices are to be replaced with
+	// symlinks. Unless it returns true, Run stops with ErrAborted. It is
+	// not called in dry runs.
+	Confirm func(files int, bytes uint64) bool
+	// DryRun only logs what would be done, without modifying any files.
+	DryRun bool
+	// NoDotFiles excludes files whose name starts with a dot.
+	NoDotFiles bool
+	// SkipVCS skips .git, .hg and .svn directories, so version control
+	// metadata is never linked. They are pruned without being read, and
+	// the summary counts them, or with Files, those the listed files are
+	// in.
+	SkipVCS bool
+	// WarnSpecial logs a warning for each device file, socket and named
+	// pipe found, for trees expected to hold only regular files. They are
+	// skipped either way.
+	WarnSpecial bool
+	// Include, if not empty, restricts the run to files matching at least
+	// one of these glob patterns. See Exclude for the pattern syntax.
+	Include []string
+	// Exclude skips files and directories matching any of these glob
+	// patterns, even if they match Include. Patterns are matched against
+	// the full path one segment at a time, "**" matches any number of
+	// segments, and patterns not starting with "/" may match any trailing
+	// part of the path.
+	Exclude []string
+	// Protect lists absolute paths and glob patterns of files that are
+	// never linked, neither as duplicate nor as link target. Listed paths
+	// are also recognized under other hard-linked names.
+	Protect []string
+	// LinkEmpty also links empty files. By default, they are skipped, as
+	// linking them saves no space, both when walking and when linking
+	// groups from elsewhere, like LinkPairs and ApplyPlan.
+	LinkEmpty bool
+	// MinSize is the minimum size of files to consider.
+	MinSize uint64
+	// MaxSize, if non-zero, excludes files of this size or larger.
+	MaxSize uint64
+	// SkipRecent, if non-zero, skips files modified less than this long
+	// before they are enumerated, since they may still be written to.
+	SkipRecent time.Duration
+	// OlderThan, if not zero, skips files modified after it.
+	OlderThan time.Time
+	// MinSavings, if non-zero, skips groups that would free less than
+	// this many bytes, i.e. whose file size times the number of files to
+	// link is smaller. Unlike MinSize, this lets many small duplicates
+	// through if there are enough of them.
+	MinSavings uint64
+	// MaxFreed, if non-zero, stops linking once this many bytes have been
+	// freed. The remaining duplicates are only logged, as in a dry run.
+	// Dry runs apply it too, so they show what such a run would do.
+	MaxFreed uint64
+	// MinCount, if non-zero, skips groups with fewer than this many files.
+	MinCount int
+	// PrefixBytes, if non-zero, makes a first checksum pass over only this
+	// many leading bytes, and fully checksums only files that still match.
+	PrefixBytes int64
+	// Hash is the checksum algorithm, one of Hashes. Defaults to
+	// DefaultHash.
+	Hash string
+	// HashBits selects the output size of blake2b, one of 256 (the
+	// default), 384 or 512. The size is part of the algorithm name in
+	// reports and the hash cache.
+	HashBits int
+	// SmallFile, if non-zero, groups files smaller than this by their
+	// contents instead of a checksum, which is cheaper for tiny files.
+	SmallFile int64
+	// ReadBuffer is the size of the buffer each checksum worker reads
+	// files with. Defaults to DefaultReadBuffer. Larger buffers, up to a
+	// few MiB, mean fewer system calls, which can help on fast storage.
+	ReadBuffer int
+	// Mmap memory-maps files of at least MmapMin bytes to checksum them,
+	// which saves copying their contents. Files that cannot be mapped,
+	// or all files on platforms without mmap, are read as usual. It has
+	// no effect with MaxRead.
+	Mmap bool
+	// MmapMin is the size from which files are mapped with Mmap.
+	// Defaults to DefaultMmapMin.
+	MmapMin int64
+	// TrustMtime groups files by size and mtime instead of checksumming
+	// them. This is only safe on trees where files with the same size and
+	// mtime are known to be identical, such as backups made with rsync
+	// --link-dest. Unless Verify is set, files are linked without ever
+	// comparing their contents.
+	TrustMtime bool
+	// MaxRead, if non-zero, limits the combined read rate of all checksum
+	// workers to this many bytes per second.
+	MaxRead int64
+	// FailOnUnreadable stops the run before linking anything if any
+	// candidate file could not be opened, stat'd or read. Otherwise, such
+	// files are skipped.
+	FailOnUnreadable bool
+	// Verify compares files byte-for-byte before linking them. It is
+	// always enabled for hashes that are not collision resistant.
+	Verify bool
+	// Decompress checksums .gz and .zst files by their decompressed
+	// contents, so that files compressed differently can be found. Since
+	// such files differ on disk, matches are only logged, unless Verify
+	// finds them identical byte-for-byte. It cannot be combined with the
+	// symlink modes.
+	Decompress bool
+	// WarnMtime logs linked files whose mtime differed from the target's.
+	WarnMtime bool
+	// RequireSameMtime refuses to link files whose mtime differs from the
+	// target's.
+	RequireSameMtime bool
+	// RequireSamePerms leaves groups alone whose members differ in
+	// owner, group or mode, since linking would collapse them into one.
+	RequireSamePerms bool
+	// SameDirOnly only links duplicates within the same directory.
+	SameDirOnly bool
+	// Keep selects which member of a group the others are linked to, one
+	// of KeepPolicies. Defaults to DefaultKeep, the member with the most
+	// links. The path policies compare the number of path components
+	// first, then the length of the path.
+	Keep string
+	// Prefer lists path prefixes. A group member whose path is one of
+	// them or inside it is the link target, whatever Keep says. Prefixes
+	// match whole path components only. Earlier prefixes win over later
+	// ones.
+	Prefer []string
+	// AllowSpecialBits allows linking files with the setuid, setgid or
+	// sticky bit set. Otherwise, such files are left alone.
+	AllowSpecialBits bool
+	// MaxLinks, if non-zero, is the most links a link target may have.
+	// Once a target has that many, the next file of the group becomes the
+	// target for the rest. This also happens if linking fails because the
+	// filesystem's limit has been reached.
+	MaxLinks uint64
+	// Checkpoint, if set, is a file in which completed groups are recorded
+	// while linking, so a restarted run can skip them. It is removed once
+	// a run completes, and ignored in dry runs.
+	Checkpoint string
+	// AuditLog, if set, is a file to which a line of JSON is appended for
+	// each link as it is made, or would be made in dry runs.
+	AuditLog string
+	// Store, if set, is a directory used as a content-addressed store:
+	// the files of each group are linked to <Store>/<hash[:2]>/<hash>,
+	// which is created as a link to one of them if it does not exist.
+	// Files without a duplicate among those found are checksummed too,
+	// and linked to or added to the store the same way. The store must
+	// be on the same filesystem as the files.
+	Store string
+	// SymlinkDevice, if set, is a path on a preferred device. Files on
+	// other devices that have an identical copy on it are replaced with
+	// symlinks to that copy. This is never done otherwise, since programs
+	// may treat symlinks differently from files.
+	SymlinkDevice string
+	// UseSymlinks replaces files with relative symlinks to their link
+	// target where hard links are not possible: across devices, and on
+	// filesystems that do not support them. A file's space is freed just
+	// the same, but programs may treat symlinks differently from files.
+	UseSymlinks bool
+	// Sync fsyncs the directories of all replaced files at the end of the
+	// run, so the changes are on disk, e.g. before taking a snapshot. This
+	// costs a disk flush per directory.
+	Sync bool
+	// Reflink shares data extents between duplicates (Linux FICLONE)
+	// instead of hard-linking them. The files keep separate i-nodes.
+	Reflink bool
+	// ReflinkFallback hard-links files if reflinking is not supported by
+	// the filesystem. Otherwise, such files are skipped.
+	ReflinkFallback bool
+	// CacheFile, if set, is a file in which checksums are kept across
+	// runs, keyed by i-node, size and mtime. Files whose size, mtime and
+	// i-node have not changed are not read again, even if they are found
+	// under a different path or root, e.g. through a bind mount.
+	CacheFile string
+	// Recover cleans up temp files left behind by an interrupted run
+	// before walking. Without it, such files are ignored if their original
+	// still exists, and abort the run otherwise.
+	Recover bool
+	// TopExtensions is the number of file extensions to list in the final
+	// breakdown of savings by extension. Zero disables the breakdown.
+	TopExtensions int
+	// EventsAddr, if set, is a Unix socket (if it contains a slash) or
+	// TCP host:port to which progress is sent as newline-delimited JSON
+	// once a second.
+	EventsAddr string
+	// Progress shows progress bars on stderr.
+	Progress bool
+	// ProgressFunc, if set, is called about once a second with the
+	// current phase and how many of its items are done, for callers that
+	// show progress their own way. It replaces the progress bars and is
+	// called from its own goroutine. total is zero while not known yet.
+	ProgressFunc func(phase string, done, total int64)
+	// LogProgress, if non-zero, logs how far the run has got at this
+	// interval, as a plain text alternative to progress bars.
+	LogProgress time.Duration
+	// DBDir, if set, is a directory in which checksums are kept in temp
+	// files instead of in memory, for trees with too many files to hold
+	// them all in RAM. Only the checksum table moves to disk: the paths
+	// of all candidates are still held in memory while walking and
+	// linking. The files are removed at the end of the run.
+	DBDir string
+	// Manifest, if set, is a file to which the checksums of all files are
+	// written, in the format checked by sha256sum -c, b2sum -c and the
+	// like. Only files that were checksummed are listed, i.e. not those
+	// without another file of the same size (or prefix, with PrefixBytes).
+	// Sums from blake2b with fewer than 512 bits are tagged with their
+	// size like by b2sum --tag, so that b2sum -c checks them without -l.
+	Manifest string
+	// Dump, if set, is a file to which every checksum and the paths
+	// having it are written after checksumming, sorted by checksum, see
+	// treeinfo.String. Like Manifest, it only lists checksummed files.
+	Dump string
+	// LogHashes logs the checksum of each file at info instead of debug
+	// level.
+	LogHashes bool
+	// MemStats logs the heap usage at the end of each phase, along with
+	// its peak so far, and how many distinct checksums there are.
+	MemStats bool
+	// Logger receives all log output. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// DefaultReadBuffer is the read buffer size used if Config.ReadBuffer is
+// zero.
+const DefaultReadBuffer = 32 * 1024
+
+// DefaultMmapMin is the smallest file memory-mapped with Config.Mmap if
+// Config.MmapMin is not set.
+const DefaultMmapMin = 16 << 20
+
+// MaxBlockReport is the largest block size allowed for Config.BlockReport.
+// Each checksum worker holds two buffers of that size.
+const MaxBlockReport = 64 << 20
+
+// maxJobsPerCPU is how many jobs per CPU are considered reasonable. Since
+// checksumming is mostly I/O bound on slow disks, some oversubscription
+// can help, but thousands of workers only thrash.
+const maxJobsPerCPU = 16
+
+// ErrAborted is returned by Run if Config.Confirm did not confirm the
+// deduplication.
+var ErrAborted = errors.New("deduplication not confirmed")
+
+// ErrConfig is wrapped by the errors Run returns for invalid Configs.
+var ErrConfig = errors.New("invalid configuration")
+
+// ErrWalk is wrapped by the errors Run returns if enumerating files
+// failed.
+var ErrWalk = errors.New("could not enumerate files")
+
+// FatalError is returned (possibly wrapped) by Run for problems with a
+// single file that make it unsafe to continue, such as a file with a
+// negative size or a leftover temp file without its original. Callers
+// can use errors.As to find out which file it was.
+type FatalError struct {
+	Path string // The file in question.
+	Op   string // What was being done, e.g. "walk" or "stat".
+	Err  error
+}
+
+func (e *FatalError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// Group describes what was (or would be) done with one group of files
+// sharing a checksum.
+type Group struct {
+	Hash      string   `json:"hash"`
+	Algorithm string   `json:"algorithm"`
+	Target    string   `json:"target"`
+	Linked    []string `json:"linked"`
+	Size      int64    `json:"size"`
+	Savings   uint64   `json:"savings"`
+}
+
+// Result summarizes a deduplication run.
+type Result struct {
+	FileCount      int
+	CheckedCount   int
+	DupeCount      int
+	FreedBytes     uint64
+	HashedCount    int
+	BytesRead      int64
+	CrossDevGroups int
+	CrossDirDupes  int
+	HashCollisions int
+	PermGroups     int
+	SmallGroups    int
+	Vanished       int
+	Resized        int
+	Symlinked      int
+	Groups         []Group
+	// Unreadable lists the candidate files that could not be checksummed,
+	// or on Windows, not even opened to get their file ID.
+	Unreadable []string
+	// Candidates lists the files that would be checksummed, sorted. It is
+	// only set with Config.ListCandidates.
+	Candidates []string
+	// DevSavings holds the space freed on each device, by device ID.
+	DevSavings map[uint64]uint64
+	// Durations holds the wall time spent in each phase of the run:
+	// enumerate, prefix, checksum and dedupe.
+	Durations map[string]time.Duration
+	// Bench holds the results of Config.Bench.
+	Bench []BenchResult
+	// BlockReport holds the results of Config.BlockReport.
+	BlockReport *BlockReport
+}
+
+// fileID identifies a file by device and i-node number. With multiple
+// roots, i-node numbers alone are not unique.
+type fileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// sizeKey buckets candidate files by device and size.
+type sizeKey struct {
+	Dev  uint64
+	Size int64
+}
+
+// compressedSize is the sizeKey.Size of files checksummed decompressed,
+// which can have the same contents whatever their size on disk.
+const compressedSize = -1
+
+// fileMeta is the file metadata used when choosing and linking files,
+// see statFile.
+type fileMeta struct {
+	ID    fileID
+	Size  int64
+	Mtime time.Time
+	Mode  fs.FileMode
+	Nlink uint64
+	UID   uint32
+	GID   uint32
+}
+
+// treeinfo holds the state of a single run.
+//
+// During enumeration, process may be called from several walkers at
+// once, so SizeGroups, Inodes, Dirs, DepthBases, Specials, DevStats,
+// FileCount, Unreadable, vcsSkipped and the skip counters must only be
+// touched with RWLock held. The checksum workers likewise only add to the
+// sums map they are given, Unreadable and HashedSizes under RWLock, and
+// may read Sizes, which is not modified after enumeration. The dedupe
+// workers update the counters, Groups, ExtStats and storeSources under
+// RWLock. The remaining fields are only used from the goroutine calling
+// Run.
+type treeinfo struct {
+	RWLock         *sync.RWMutex
+	Sums           sumStore
+	SizeGroups     map[sizeKey][]string
+	Inodes         map[fileID]bool
+	Dirs           map[fileID]bool
+	DepthBases     map[string]int
+	Specials       map[string]int
+	PathList       []string
+	Sizes          map[string]int64
+	HashedSizes    map[string]int64
+	DupeCount      int
+	FileCount      int
+	SizeSkipped    int
+	RecentSkipped  int
+	NewerSkipped   int
+	VCSDirsSkipped int
+	EmptySkipped   int
+	ExistingLinks  int
+	HashedCount    int
+	BytesRead      int64
+	CrossDirDupes  int
+	CrossDevGroups int
+	HashCollisions int
+	PermGroups     int
+	SmallGroups    int
+	SmallForgone   uint64
+	FewGroups      int
+	FewForgone     uint64
+	Vanished       int
+	Resized        int
+	Decompressed   int
+	Groups         []Group
+	Unreadable     []string
+	ResumedGroups  int
+	ExtStats       map[string]*extStats
+	DevSavings     map[uint64]uint64
+	DevStats       map[uint64]*devStats
+	Symlinked      int
+	DeferredFiles  int
+	DeferredBytes  uint64
+	Durations      map[string]time.Duration
+	cfg            Config
+	ctx            context.Context
+	cache          *hashCache
+	mem            *memWatch
+	prog           *progress
+	throttle       *throttle
+	checkpoint     *checkpoint
+	changedDirs    map[string]bool
+	budgetUsed     uint64
+	symlinkDev     uint64
+	vcsSkipped     map[string]bool
+	storeSources   map[string]string
+	audit          *auditLog
+	protect        *protection
+	descend        func(dir string) error
+	progbar        *barReporter
+	log            *slog.Logger
+}
+
+func newTI() treeinfo {
+	var ti treeinfo
+	var newmtx sync.RWMutex
+	ti.Sums = memStore{}
+	ti.SizeGroups = make(map[sizeKey][]string)
+	ti.DevSavings = make(map[uint64]uint64)
+	ti.DevStats = make(map[uint64]*devStats)
+	ti.changedDirs = make(map[string]bool)
+	ti.Inodes = make(map[fileID]bool)
+	ti.Dirs = make(map[fileID]bool)
+	ti.DepthBases = make(map[string]int)
+	ti.Specials = make(map[string]int)
+	ti.Sizes = make(map[string]int64)
+	ti.HashedSizes = make(map[string]int64)
+	ti.ExtStats = make(map[string]*extStats)
+	ti.Durations = make(map[string]time.Duration)
+	ti.storeSources = make(map[string]string)
+	ti.vcsSkipped = make(map[string]bool)
+	ti.RWLock = &newmtx
+	ti.prog = newProgress()
+	return ti
+}
+
+// String returns one line per checksum in Sums, sorted by checksum: the
+// algorithm and the checksum as written to reports, a colon, and the
+// sorted paths having it, each preceded by a tab.
+func (ti treeinfo) String() string {
+	var r []string
+	//nolint:errcheck // The callback never fails
+	ti.Sums.groups(func(sum string, paths []string) error {
+		hash, algo := ti.describeSum(sum)
+		paths = slices.Clone(paths)
+		slices.Sort(paths)
+		r = append(r, fmt.Sprintf("%s %s:\t%s", hash, algo, strings.Join(paths, "\t")))
+		return nil
+	})
+	slices.Sort(r)
+	return strings.Join(r, "\n")
+}
+
+func (ti *treeinfo) result(freed uint64) Result {
+	return Result{
+		FileCount:      ti.FileCount,
+		CheckedCount:   len(ti.PathList),
+		DupeCount:      ti.DupeCount,
+		FreedBytes:     freed,
+		HashedCount:    ti.HashedCount,
+		BytesRead:      ti.BytesRead,
+		CrossDevGroups: ti.CrossDevGroups,
+		CrossDirDupes:  ti.CrossDirDupes,
+		HashCollisions: ti.HashCollisions,
+		PermGroups:     ti.PermGroups,
+		SmallGroups:    ti.SmallGroups,
+		Vanished:       ti.Vanished,
+		Resized:        ti.Resized,
+		Symlinked:      ti.Symlinked,
+		Groups:         ti.Groups,
+		Unreadable:     ti.Unreadable,
+		DevSavings:     ti.DevSavings,
+		Durations:      ti.Durations,
+	}
+}
+
+// setDefaults fills in the defaults for unset fields of cfg and checks
+// the others.
+func (cfg *Config) setDefaults() error {
+	if len(cfg.Roots) == 0 && cfg.Files == nil {
+		cfg.Roots = []string{"."}
+	}
+	if cfg.Jobs < 0 {
+		return fmt.Errorf("invalid number of jobs: %d", cfg.Jobs)
+	}
+	if cfg.Jobs == 0 {
+		cfg.Jobs = runtime.NumCPU()
+	}
+	if cfg.AnalyzeTop < 0 {
+		return fmt.Errorf("invalid number of groups to analyze: %d", cfg.AnalyzeTop)
+	}
+	if cfg.BlockReport < 0 || cfg.BlockReport > MaxBlockReport || cfg.BlockReport&(cfg.BlockReport-1) != 0 {
+		return fmt.Errorf("invalid block size: %d, must be a power of two up to %d", cfg.BlockReport, MaxBlockReport)
+	}
+	for _, jobs := range cfg.Bench {
+		if jobs <= 0 {
+			return fmt.Errorf("invalid number of jobs to benchmark: %d", jobs)
+		}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Hash == "" {
+		cfg.Hash = DefaultHash
+	}
+	if cfg.Keep == "" {
+		cfg.Keep = DefaultKeep
+	}
+	if cfg.ReadBuffer < 0 {
+		return fmt.Errorf("invalid read buffer size: %d", cfg.ReadBuffer)
+	}
+	if cfg.ReadBuffer == 0 {
+		cfg.ReadBuffer = DefaultReadBuffer
+	}
+	if cfg.MmapMin <= 0 {
+		cfg.MmapMin = DefaultMmapMin
+	}
+	if cfg.Jobs > maxJobsPerCPU*runtime.NumCPU() {
+		cfg.Logger.Warn("Very many jobs, this is likely to be slower than fewer", "jobs", cfg.Jobs, "cpus", runtime.NumCPU())
+	}
+	hash, err := withBits(cfg.Hash, cfg.HashBits)
+	if err != nil {
+		return err
+	}
+	cfg.Hash = hash
+	if err := checkKeep(cfg.Keep); err != nil {
+		return err
+	}
+	if _, err := newHash(cfg.Hash); err != nil {
+		return err
+	}
+	if cfg.TrustMtime && (cfg.Manifest != "" || cfg.Store != "") {
+		return errors.New("cannot write a manifest or use a store without checksumming files")
+	}
+	if (cfg.LinkPairs != nil || cfg.ApplyPlan != "") && cfg.Checkpoint != "" {
+		return errors.New("cannot use a checkpoint when checking links or applying a plan")
+	}
+	if cfg.LinkPairs != nil && cfg.ApplyPlan != "" {
+		return errors.New("cannot check links and apply a plan at the same time")
+	}
+	if cfg.ExportPlan != "" && (!cfg.DryRun || cfg.ApplyPlan != "") {
+		return errors.New("a plan can only be exported by a dry run that does not apply one")
+	}
+	if cfg.ApplyPlan != "" {
+		// The first member of each group is the plan's target.
+		cfg.Keep = "first"
+		cfg.Prefer = nil
+	}
+	if cfg.Decompress && (cfg.TrustMtime || cfg.Manifest != "" || cfg.Store != "") {
+		return errors.New("cannot write a manifest, use a store or trust mtimes when checksumming decompressed contents")
+	}
+	if cfg.Decompress && (cfg.UseSymlinks || cfg.SymlinkDevice != "") {
+		return errors.New("cannot replace files with symlinks when checksumming decompressed contents")
+	}
+	if !collisionResistant(cfg.Hash) && !cfg.Verify && !cfg.TrustMtime {
+		cfg.Logger.Info("Hash is not collision resistant, enabling verification", "hash", cfg.Hash)
+		cfg.Verify = true
+	}
+	return checkGlobs(slices.Concat(cfg.Include, cfg.Exclude, cfg.Protect))
+}
+
+// Run walks cfg.Roots, checksums all candidate files and hard-links
+// duplicates. The returned Result is filled in as far as the run got,
+// even if an error is returned.
+//
+// Canceling ctx stops the run at the next safe point: link operations
+// in progress are completed (or rolled back) first, and the returned
+// error wraps ctx.Err().
+func Run(ctx context.Context, cfg Config) (Result, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return Result{}, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+	logger := cfg.Logger
+	ti := newTI()
+	ti.cfg = cfg
+	ti.ctx = ctx
+	ti.log = logger
+	if cfg.MaxRead > 0 {
+		ti.throttle = newThrottle(cfg.MaxRead)
+	}
+	if len(cfg.Protect) > 0 {
+		ti.protect = newProtection(cfg.Protect)
+	}
+	if cfg.SymlinkDevice != "" {
+		fi, err := os.Stat(cfg.SymlinkDevice)
+		if err != nil {
+			return Result{}, fmt.Errorf("could not stat symlink device: %w", err)
+		}
+		meta, err := statFile(cfg.SymlinkDevice, fi)
+		if err != nil {
+			return Result{}, fmt.Errorf("could not stat symlink device: %w", err)
+		}
+		ti.symlinkDev = meta.ID.Dev
+	}
+	if cfg.CacheFile != "" {
+		c, err := ti.loadCache(cfg.CacheFile)
+		if err != nil {
+			return Result{}, fmt.Errorf("could not load hash cache: %w", err)
+		}
+		ti.cache = c
+	}
+	if cfg.EventsAddr != "" {
+		conn, err := dialEvents(cfg.EventsAddr)
+		if err != nil {
+			return Result{}, err
+		}
+		stop, done := make(chan struct{}), make(chan struct{})
+		go ti.sendEvents(conn, stop, done)
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	if cfg.LogProgress > 0 {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go ti.logProgress(cfg.LogProgress, stop, done)
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	if cfg.MemStats {
+		ti.mem = &memWatch{log: logger}
+		stop, done := make(chan struct{}), make(chan struct{})
+		go ti.mem.watch(stop, done)
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	if cfg.ProgressFunc != nil {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go ti.callProgress(cfg.ProgressFunc, stop, done)
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	if cfg.LinkPairs != nil {
+		pairs, err := ti.checkPairs()
+		if err != nil {
+			return ti.result(0), fmt.Errorf("checking links stopped: %w", err)
+		}
+		ti.Sums = pairs
+		return ti.link()
+	}
+	if cfg.ApplyPlan != "" {
+		groups, err := ti.readPlan(cfg.ApplyPlan)
+		if err != nil {
+			return ti.result(0), fmt.Errorf("could not read plan: %w", err)
+		}
+		ti.Sums = groups
+		return ti.link()
+	}
+	start := time.Now()
+	if cfg.Recover {
+		for _, root := range cfg.Roots {
+			if err := ti.recoverTemps(root); err != nil {
+				return ti.result(0), fmt.Errorf("recovering temp files in %s failed: %w", root, err)
+			}
+		}
+	}
+	ti.prog.setPhase("enumerate", 0)
+	if cfg.Files != nil {
+		logger.Info("Enumerating listed files", "files", len(cfg.Files))
+		if err := ti.addListed(); err != nil {
+			return ti.result(0), fmt.Errorf("%w from list: %w", ErrWalk, err)
+		}
+	} else {
+		for _, root := range cfg.Roots {
+			logger.Info("Enumerating files", "root", root)
+			before := ti.FileCount
+			err := ti.walk(root)
+			if err != nil {
+				return ti.result(0), fmt.Errorf("%w in %s: %w", ErrWalk, root, err)
+			}
+			logger.Info("Root enumerated", "root", root, "files", ti.FileCount-before)
+		}
+	}
+	for key, paths := range ti.SizeGroups {
+		if len(paths) < 2 && cfg.Store == "" {
+			// With a store, even files without a duplicate here may
+			// have one there.
+			continue
+		}
+		ti.PathList = append(ti.PathList, paths...)
+		if key.Size == compressedSize {
+			// addFile has recorded their sizes.
+			continue
+		}
+		for _, path := range paths {
+			ti.Sizes[path] = key.Size
+		}
+	}
+	elapsed := time.Since(start)
+	ti.phaseDone("enumerate", elapsed)
+	logger.Info("Files enumerated", "total", ti.FileCount, "tocheck", len(ti.PathList), "size_skipped", ti.SizeSkipped,
+		"recent_skipped", ti.RecentSkipped, "newer_skipped", ti.NewerSkipped, "vcs_dirs_skipped", ti.VCSDirsSkipped,
+		"empty_skipped", ti.EmptySkipped,
+		"existing_links", ti.ExistingLinks, "inodes", len(ti.Inodes),
+		"time", elapsed, "per_sec", perSec(float64(ti.FileCount), elapsed))
+	ti.logSpecials()
+	if cfg.ListDevices {
+		ti.logDevices()
+		return ti.result(0), nil
+	}
+	if len(cfg.Bench) > 0 {
+		results, err := ti.bench()
+		res := ti.result(0)
+		res.Bench = results
+		if err != nil {
+			return res, fmt.Errorf("benchmark stopped: %w", err)
+		}
+		return res, nil
+	}
+	if cfg.BlockReport > 0 {
+		br, err := ti.blockReport()
+		res := ti.result(0)
+		res.BlockReport = br
+		if err != nil {
+			return res, fmt.Errorf("block report stopped: %w", err)
+		}
+		return res, nil
+	}
+	if cfg.ListCandidates {
+		res := ti.result(0)
+		res.Candidates = slices.Clone(ti.PathList)
+		slices.Sort(res.Candidates)
+		return res, nil
+	}
+	if len(ti.PathList) == 0 {
+		logger.Info("Nothing to deduplicate, no two candidate files have the same size")
+		return ti.result(0), nil
+	}
+
+	tohash := ti.PathList
+	if cfg.PrefixBytes > 0 && !cfg.TrustMtime {
+		start = time.Now()
+		prefixes, err := ti.newStore()
+		if err != nil {
+			return ti.result(0), err
+		}
+		err = ti.hashFiles(ti.PathList, cfg.PrefixBytes, "Prefix", prefixes)
+		if err == nil {
+			tohash = nil
+			err = prefixes.groups(func(_ string, paths []string) error {
+				if len(paths) >= 2 || cfg.Store != "" {
+					tohash = append(tohash, paths...)
+				}
+				return nil
+			})
+		}
+		if err := prefixes.close(); err != nil {
+			logger.Warn("Could not remove checksum store", "error", err)
+		}
+		if err != nil {
+			return ti.result(0), fmt.Errorf("prefix checksumming stopped: %w", err)
+		}
+		elapsed = time.Since(start)
+		ti.phaseDone("prefix", elapsed)
+		logger.Info("Prefixes checksummed", "total", len(ti.PathList), "remaining", len(tohash),
+			"time", elapsed, "per_sec", perSec(float64(len(ti.PathList)), elapsed))
+	}
+
+	start = time.Now()
+	sums, err := ti.newStore()
+	if err != nil {
+		return ti.result(0), err
+	}
+	defer func() {
+		if err := sums.close(); err != nil {
+			logger.Warn("Could not remove checksum store", "error", err)
+		}
+	}()
+	if cfg.TrustMtime {
+		logger.Warn("Trusting size and mtime instead of checksumming, files that differ may be linked",
+			"verify", cfg.Verify)
+		err = ti.metaFiles(tohash, sums)
+	} else {
+		err = ti.hashFiles(tohash, 0, "Checksum", sums)
+	}
+	if ti.cache != nil {
+		// Save even if interrupted, the checksums we have are still good.
+		if err := ti.cache.save(); err != nil {
+			logger.Error("Could not write hash cache", "path", cfg.CacheFile, "error", err)
+		}
+		logger.Info("Hash cache updated", "path", cfg.CacheFile, "hits", ti.cache.hits, "updates", ti.cache.updates)
+	}
+	if err != nil {
+		return ti.result(0), fmt.Errorf("checksumming stopped: %w", err)
+	}
+	ti.Sums = sums
+	elapsed = time.Since(start)
+	ti.phaseDone("checksum", elapsed)
+	// The checksum workers count the bytes they read in prog.bytes.
+	ti.HashedCount = len(tohash)
+	ti.BytesRead = ti.prog.bytes.Load()
+	//nolint:gosec // Byte counts are never negative
+	logger.Info("Files checksummed", "total", len(tohash), "unreadable", len(ti.Unreadable), "time", elapsed,
+		"per_sec", perSec(float64(len(tohash)), elapsed), "bytes", humanize.Bytes(uint64(ti.BytesRead)),
+		"mb_per_sec", perSec(float64(ti.BytesRead)/1e6, elapsed))
+	if cfg.MemStats {
+		ti.logSumStats()
+	}
+	if cfg.Manifest != "" {
+		if err := ti.writeManifest(cfg.Manifest); err != nil {
+			return ti.result(0), fmt.Errorf("could not write manifest: %w", err)
+		}
+		logger.Info("Manifest written", "path", cfg.Manifest, "files", ti.Sums.files())
+	}
+	if cfg.Dump != "" {
+		dump := ti.String()
+		if dump != "" {
+			dump += "\n"
+		}
+		if err := atomicfile.WriteFile(cfg.Dump, []byte(dump)); err != nil {
+			return ti.result(0), fmt.Errorf("could not write dump: %w", err)
+		}
+		logger.Info("Checksums dumped", "path", cfg.Dump, "files", ti.Sums.files())
+	}
+	if cfg.FailOnUnreadable && len(ti.Unreadable) > 0 {
+		return ti.result(0), fmt.Errorf("%d files could not be read, first one: %s", len(ti.Unreadable), ti.Unreadable[0])
+	}
+	if cfg.Analyze {
+		return ti.result(0), ti.analyze()
+	}
+	return ti.link()
+}
+
+// link links the groups in ti.Sums, after asking for confirmation if
+// needed, and returns the result of the run.
+func (ti *treeinfo) link() (Result, error) {
+	if ti.cfg.Confirm != nil && !ti.cfg.DryRun {
+		sets, total, err := ti.dupeSets()
+		if err != nil {
+			return ti.result(0), err
+		}
+		files := 0
+		for _, s := range sets {
+			files += s.files - 1
+		}
+		if !ti.cfg.Confirm(files, total) {
+			return ti.result(0), ErrAborted
+		}
+	}
+	if ti.cfg.Checkpoint != "" && !ti.cfg.DryRun {
+		c, err := openCheckpoint(ti.cfg.Checkpoint)
+		if err != nil {
+			return ti.result(0), fmt.Errorf("could not open checkpoint: %w", err)
+		}
+		ti.log.Info("Using checkpoint", "path", ti.cfg.Checkpoint, "done", len(c.done))
+		ti.checkpoint = c
+	}
+	if ti.cfg.AuditLog != "" {
+		a, err := openAuditLog(ti.cfg.AuditLog)
+		if err != nil {
+			return ti.result(0), fmt.Errorf("could not open audit log: %w", err)
+		}
+		ti.audit = a
+	}
+	start := time.Now()
+	ti.prog.setPhase("dedupe", ti.Sums.files())
+	ti.log.Info("Deduplicating", "files", ti.Sums.files(), "keep", ti.cfg.Keep)
+	s, err := ti.dedupe()
+	if len(ti.changedDirs) > 0 {
+		// Even after a failure, the links made so far should be durable.
+		syncstart := time.Now()
+		if err := ti.syncDirs(); err != nil {
+			ti.log.Error("Could not sync directories", "error", err)
+		}
+		ti.log.Info("Directories synced", "dirs", len(ti.changedDirs), "time", time.Since(syncstart))
+	}
+	if ti.checkpoint != nil {
+		if err := ti.checkpoint.close(err == nil); err != nil {
+			ti.log.Error("Could not close checkpoint", "path", ti.cfg.Checkpoint, "error", err)
+		}
+	}
+	if ti.audit != nil {
+		if err := ti.audit.close(); err != nil {
+			ti.log.Error("Could not close audit log", "path", ti.cfg.AuditLog, "error", err)
+		}
+	}
+	if err != nil {
+		return ti.result(s), fmt.Errorf("deduplication failed: %w", err)
+	}
+	elapsed := time.Since(start)
+	ti.phaseDone("dedupe", elapsed)
+	ti.log.Info("Deduplication complete", "freedspace", humanize.Bytes(s),
+		"dedupes", ti.DupeCount, "crossdev_skipped", ti.CrossDevGroups, "hash_collisions", ti.HashCollisions,
+		"perms_skipped", ti.PermGroups, "minsavings_skipped", ti.SmallGroups,
+		"minsavings_forgone", humanize.Bytes(ti.SmallForgone), "mincount_skipped", ti.FewGroups,
+		"mincount_forgone", humanize.Bytes(ti.FewForgone), "vanished", ti.Vanished, "resized", ti.Resized,
+		"decompressed_only", ti.Decompressed, "checkpoint_skipped", ti.ResumedGroups,
+		"crossdir_skipped", ti.CrossDirDupes, "symlinked", ti.Symlinked,
+		"maxfreed_deferred", ti.DeferredFiles, "maxfreed_deferred_bytes", humanize.Bytes(ti.DeferredBytes),
+		"time", elapsed, "per_sec", perSec(float64(ti.DupeCount), elapsed))
+	if ti.cfg.DryRun {
+		ti.logDryRunSummary()
+	}
+	ti.logDevSavings()
+	if ti.cfg.TopExtensions > 0 {
+		ti.logExtStats(ti.cfg.TopExtensions)
+	}
+	if ti.cfg.ExportPlan != "" {
+		if err := ti.writePlan(ti.cfg.ExportPlan); err != nil {
+			return ti.result(s), fmt.Errorf("could not write plan: %w", err)
+		}
+		ti.log.Info("Plan written", "path", ti.cfg.ExportPlan, "groups", len(ti.Groups))
+	}
+	return ti.result(s), nil
+}
+
+// perSec returns the rate of n per second over d, or zero if no time
+// has passed.
+func perSec(n float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return n / d.Seconds()
+}
+
+// logDryRunSummary logs an overview of what a real run would link, to
+// help decide whether it is worthwhile.
+func (ti *treeinfo) logDryRunSummary() {
+	if len(ti.Groups) == 0 {
+		ti.log.Info("Dry run found no duplicates")
+		return
+	}
+	largest, biggest := &ti.Groups[0], &ti.Groups[0]
+	for i := range ti.Groups {
+		g := &ti.Groups[i]
+		if len(g.Linked) > len(largest.Linked) {
+			largest = g
+		}
+		if g.Size > biggest.Size {
+			biggest = g
+		}
+	}
+	//nolint:gosec // File sizes are never negative
+	bsize := uint64(biggest.Size)
+	ti.log.Info("Dry run summary", "groups", len(ti.Groups),
+		"largest_group", len(largest.Linked)+1, "largest_group_target", largest.Target,
+		"biggest_file", biggest.Target, "biggest_size", humanize.Bytes(bsize))
+}
+
+// devStats counts the candidate files on one device. Files with several
+// names are only counted once.
+type devStats struct {
+	Files int
+	Bytes uint64
+}
+
+// logDevices logs the devices candidate files were found on, for
+// Config.ListDevices.
+func (ti *treeinfo) logDevices() {
+	devs := make([]uint64, 0, len(ti.DevStats))
+	for dev := range ti.DevStats {
+		devs = append(devs, dev)
+	}
+	slices.Sort(devs)
+	for _, dev := range devs {
+		ds := ti.DevStats[dev]
+		ti.log.Info("Device", "dev", dev, "files", ds.Files, "bytes", humanize.Bytes(ds.Bytes))
+	}
+}
+
+// logDevSavings logs the space freed on each device.
+func (ti *treeinfo) logDevSavings() {
+	devs := make([]uint64, 0, len(ti.DevSavings))
+	for dev := range ti.DevSavings {
+		devs = append(devs, dev)
+	}
+	slices.Sort(devs)
+	msg := "Savings by device"
+	if ti.cfg.DryRun {
+		msg = "Potential savings by device"
+	}
+	for _, dev := range devs {
+		ti.log.Info(msg, "dev", dev, "bytes", humanize.Bytes(ti.DevSavings[dev]))
+	}
+}
+
+// extStats counts the duplicates with one file extension.
+type extStats struct {
+	Files int
+	Bytes uint64
+}
+
+// addExtStats records name as a (would-be) linked duplicate of size bytes.
+// The caller must hold RWLock.
+func (ti *treeinfo) addExtStats(name string, size uint64) {
+	ext := strings.ToLower(filepath.Ext(name))
+	st := ti.ExtStats[ext]
+	if st == nil {
+		st = &extStats{}
+		ti.ExtStats[ext] = st
+	}
+	st.Files++
+	st.Bytes += size
+}
+
+// logExtStats logs the n extensions with the largest savings, largest
+// first.
+func (ti *treeinfo) logExtStats(n int) {
+	exts := make([]string, 0, len(ti.ExtStats))
+	for ext := range ti.ExtStats {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		a, b := ti.ExtStats[exts[i]], ti.ExtStats[exts[j]]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return exts[i] < exts[j]
+	})
+	if len(exts) > n {
+		exts = exts[:n]
+	}
+	msg := "Savings by extension"
+	if ti.cfg.DryRun {
+		msg = "Potential savings by extension"
+	}
+	for _, ext := range exts {
+		st := ti.ExtStats[ext]
+		name := ext
+		if name == "" {
+			name = "(none)"
+		}
+		ti.log.Info(msg, "ext", name, "files", st.Files, "bytes", humanize.Bytes(st.Bytes))
+	}
+}
@@ -0,0 +1,143 @@
+package dedup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// eventInterval is how often progress events are sent.
+const eventInterval = time.Second
+
+// progress tracks how far the current phase of a run has got. The
+// counters are updated by the walkers and checksum workers, so they are
+// atomic.
+type progress struct {
+	mu    sync.Mutex
+	phase string
+	total int64
+	start time.Time
+	done  atomic.Int64
+	bytes atomic.Int64
+}
+
+// event is a progress snapshot, sent as one line of JSON.
+type event struct {
+	Phase   string  `json:"phase"`
+	Done    int64   `json:"done"`
+	Total   int64   `json:"total"`
+	Bytes   int64   `json:"bytes"`
+	Elapsed float64 `json:"elapsed"`
+}
+
+func newProgress() *progress {
+	return &progress{phase: "start", start: time.Now()}
+}
+
+// setPhase starts a new phase with total items (zero if not known yet)
+// and resets the counters.
+func (p *progress) setPhase(phase string, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+	p.total = int64(total)
+	p.done.Store(0)
+	p.bytes.Store(0)
+}
+
+func (p *progress) snapshot() event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return event{
+		Phase:   p.phase,
+		Done:    p.done.Load(),
+		Total:   p.total,
+		Bytes:   p.bytes.Load(),
+		Elapsed: time.Since(p.start).Seconds(),
+	}
+}
+
+// dialEvents connects to addr, which is a Unix socket if it contains a
+// slash and a TCP host:port otherwise.
+func dialEvents(addr string) (net.Conn, error) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to events address: %w", err)
+	}
+	return conn, nil
+}
+
+// sendEvents writes a progress event to conn every eventInterval until
+// stop is closed, and a final one after that. It gives up on the first
+// write error, since progress events are not worth failing the run for.
+func (ti *treeinfo) sendEvents(conn net.Conn, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	t := time.NewTicker(eventInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := enc.Encode(ti.prog.snapshot()); err != nil {
+				ti.log.Warn("Could not send progress event, giving up", "error", err)
+				return
+			}
+		case <-stop:
+			ev := ti.prog.snapshot()
+			ev.Phase = "done"
+			if err := enc.Encode(ev); err != nil {
+				ti.log.Warn("Could not send progress event", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// logProgress logs a progress snapshot every interval until stop is
+// closed.
+func (ti *treeinfo) logProgress(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ev := ti.prog.snapshot()
+			//nolint:gosec // Byte counts are never negative
+			ti.log.Info("Progress", "phase", ev.Phase, "done", ev.Done, "total", ev.Total,
+				"bytes", humanize.Bytes(uint64(ev.Bytes)))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// callProgress calls fn with a progress snapshot every eventInterval until
+// stop is closed, and a final time with the phase "done" after that.
+func (ti *treeinfo) callProgress(fn func(phase string, done, total int64), stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	t := time.NewTicker(eventInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ev := ti.prog.snapshot()
+			fn(ev.Phase, ev.Done, ev.Total)
+		case <-stop:
+			ev := ti.prog.snapshot()
+			fn("done", ev.Done, ev.Total)
+			return
+		}
+	}
+}
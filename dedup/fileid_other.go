@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// statFile is only implemented on Unix-like systems and Windows.
+func statFile(path string, _ fs.FileInfo) (fileMeta, error) {
+	return fileMeta{}, &FatalError{Path: path, Op: "stat", Err: fmt.Errorf("could not get file ID: %w", errors.ErrUnsupported)}
+}
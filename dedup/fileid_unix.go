@@ -0,0 +1,26 @@
+//go:build unix
+
+package dedup
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// statFile returns the metadata of the file at path, described by info.
+func statFile(path string, info fs.FileInfo) (fileMeta, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileMeta{}, &FatalError{Path: path, Op: "stat", Err: errors.New("we somehow got a file without an inode number")}
+	}
+	return fileMeta{
+		ID:    fileID{Dev: uint64(st.Dev), Ino: st.Ino},
+		Size:  info.Size(),
+		Mtime: info.ModTime(),
+		Mode:  info.Mode(),
+		Nlink: uint64(st.Nlink),
+		UID:   st.Uid,
+		GID:   st.Gid,
+	}, nil
+}
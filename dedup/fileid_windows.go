@@ -0,0 +1,41 @@
+//go:build windows
+
+package dedup
+
+import (
+	"fmt"
+	"io/fs"
+
+	"golang.org/x/sys/windows"
+)
+
+// statFile returns the metadata of the file at path, described by info.
+// Windows only reports the file ID and link count for open files, so the
+// file is opened to get them, asking only to read its attributes and
+// sharing it fully, so files locked by other programs can be opened too.
+// Files that still cannot be opened are reported as errUnreadable. Owner
+// and group are always zero.
+func statFile(path string, info fs.FileInfo) (fileMeta, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return fileMeta{}, &FatalError{Path: path, Op: "open", Err: err}
+	}
+	h, err := windows.CreateFile(name, windows.FILE_READ_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return fileMeta{}, fmt.Errorf("%w: %w", errUnreadable, err)
+	}
+	defer windows.CloseHandle(h)
+	var d windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &d); err != nil {
+		return fileMeta{}, &FatalError{Path: path, Op: "stat", Err: fmt.Errorf("could not get file ID: %w", err)}
+	}
+	return fileMeta{
+		ID:    fileID{Dev: uint64(d.VolumeSerialNumber), Ino: uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow)},
+		Size:  info.Size(),
+		Mtime: info.ModTime(),
+		Mode:  info.Mode(),
+		Nlink: uint64(d.NumberOfLinks),
+	}, nil
+}
@@ -0,0 +1,214 @@
+package dedup
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// matchGlob reports whether path matches pattern. Patterns are matched
+// one path segment at a time using filepath.Match, and a "**" segment
+// matches any number of segments. Patterns that do not start with a
+// separator may match any trailing part of the path, so "*.jpg" matches
+// JPEG files anywhere in the tree.
+func matchGlob(pattern, path string) bool {
+	pat := strings.Split(filepath.ToSlash(pattern), "/")
+	segs := strings.Split(filepath.ToSlash(path), "/")
+	if strings.HasPrefix(pattern, "/") {
+		return matchSegments(pat, segs)
+	}
+	for i := range segs {
+		if matchSegments(pat, segs[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pat, segs []string) bool {
+	if len(pat) == 0 {
+		return len(segs) == 0
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(pat[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	if ok, err := filepath.Match(pat[0], segs[0]); err != nil || !ok {
+		return false
+	}
+	return matchSegments(pat[1:], segs[1:])
+}
+
+// checkGlobs returns an error for the first malformed pattern.
+func checkGlobs(patterns []string) error {
+	for _, p := range patterns {
+		for _, seg := range strings.Split(filepath.ToSlash(p), "/") {
+			if _, err := filepath.Match(seg, ""); err != nil {
+				return fmt.Errorf("bad pattern %q: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, path string) bool {
+	for _, p := range patterns {
+		if matchGlob(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// protection holds the Config.Protect entries, split into literal paths,
+// which are also matched by i-node, and glob patterns.
+type protection struct {
+	paths map[string]bool
+	ids   map[fileID]bool
+	globs []string
+}
+
+func newProtection(entries []string) *protection {
+	p := &protection{paths: make(map[string]bool), ids: make(map[fileID]bool)}
+	for _, e := range entries {
+		if strings.ContainsAny(e, `*?[\`) {
+			p.globs = append(p.globs, e)
+			continue
+		}
+		p.paths[filepath.Clean(e)] = true
+		// Other names for the same file must not be touched either.
+		if fi, err := os.Stat(e); err == nil {
+			if meta, err := statFile(e, fi); err == nil {
+				p.ids[meta.ID] = true
+			}
+		}
+	}
+	return p
+}
+
+// protected reports whether the file at path, described by meta, is
+// listed in Config.Protect and must not be linked in either direction.
+func (ti *treeinfo) protected(path string, meta fileMeta) bool {
+	p := ti.protect
+	if p == nil {
+		return false
+	}
+	if p.ids[meta.ID] {
+		return true
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return p.paths[path] || matchAny(p.globs, path)
+}
+
+// excludedDir reports whether the walk should not descend into path. This
+// is the case if an exclude pattern matches the directory itself, or it
+// would match everything in it, like "*/cache/*" does for ".../cache".
+func (ti *treeinfo) excludedDir(path string) bool {
+	for _, p := range ti.cfg.Exclude {
+		trimmed := strings.TrimSuffix(strings.TrimSuffix(p, "/**"), "/*")
+		if matchGlob(p, path) || (trimmed != p && matchGlob(trimmed, path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// includedFile reports whether the regular file at path passes the
+// include and exclude patterns. Excludes take precedence.
+func (ti *treeinfo) includedFile(path string) bool {
+	if matchAny(ti.cfg.Exclude, path) {
+		return false
+	}
+	return len(ti.cfg.Include) == 0 || matchAny(ti.cfg.Include, path)
+}
+
+// vcsDirs are the names of version control metadata directories skipped
+// with Config.SkipVCS.
+var vcsDirs = []string{".git", ".hg", ".svn"}
+
+// isVCSDir reports whether path is a version control metadata directory.
+func isVCSDir(path string) bool {
+	return slices.Contains(vcsDirs, filepath.Base(path))
+}
+
+// vcsDirOf returns the outermost version control metadata directory that
+// path is in, or "" if there is none.
+func vcsDirOf(path string) string {
+	segs := strings.Split(filepath.ToSlash(filepath.Dir(path)), "/")
+	for i, seg := range segs {
+		if slices.Contains(vcsDirs, seg) {
+			return filepath.FromSlash(strings.Join(segs[:i+1], "/"))
+		}
+	}
+	return ""
+}
+
+// skipVCSDir counts the version control metadata directory at path as
+// skipped, unless it has been already, and returns filepath.SkipDir. Its
+// contents are not looked at, which is the point of pruning it.
+func (ti *treeinfo) skipVCSDir(path string) error {
+	ti.log.Debug("Skipping version control directory", "path", path)
+	ti.RWLock.Lock()
+	if !ti.vcsSkipped[path] {
+		ti.vcsSkipped[path] = true
+		ti.VCSDirsSkipped++
+	}
+	ti.RWLock.Unlock()
+	return filepath.SkipDir
+}
+
+// specialType returns the kind of non-regular file mode describes, for
+// Config.WarnSpecial and the count of skipped entries.
+func specialType(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeCharDevice != 0:
+		return "char_device"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeNamedPipe != 0:
+		return "named_pipe"
+	}
+	return "other"
+}
+
+// skipSpecial counts the non-regular file at path as skipped, and with
+// Config.WarnSpecial, warns about it unless it is a symlink.
+func (ti *treeinfo) skipSpecial(path string, mode fs.FileMode) {
+	kind := specialType(mode)
+	if ti.cfg.WarnSpecial && kind != "symlink" {
+		ti.log.Warn("Found a special file, skipping it", "path", path, "type", kind)
+	}
+	ti.RWLock.Lock()
+	ti.Specials[kind]++
+	ti.RWLock.Unlock()
+}
+
+// logSpecials logs how many non-regular files of each type were skipped.
+func (ti *treeinfo) logSpecials() {
+	if len(ti.Specials) == 0 {
+		return
+	}
+	kinds := slices.Sorted(maps.Keys(ti.Specials))
+	args := make([]any, 0, 2*len(kinds))
+	for _, kind := range kinds {
+		args = append(args, kind, ti.Specials[kind])
+	}
+	ti.log.Debug("Skipped non-regular files", args...)
+}
@@ -0,0 +1,109 @@
+package dedup
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		// Relative patterns match any trailing part of the path.
+		{"*.jpg", "/a/b/x.jpg", true},
+		{"*.jpg", "x.jpg", true},
+		{"*.jpg", "/a/b/x.png", false},
+		{"b/*.jpg", "/a/b/x.jpg", true},
+		{"b/*.jpg", "/a/c/x.jpg", false},
+		{"a/*.jpg", "/a/b/x.jpg", false},
+		{"b", "/a/b/x.jpg", false},
+		{"x.jpg", "/a/b/x.jpg", true},
+		// Absolute patterns only match from the root.
+		{"/a/b/x.jpg", "/a/b/x.jpg", true},
+		{"/b/x.jpg", "/a/b/x.jpg", false},
+		{"/a/*.jpg", "/a/b/x.jpg", false},
+		{"/a/*/x.jpg", "/a/b/x.jpg", true},
+		{"/a/b", "a/b", false},
+		// "**" at the start.
+		{"**/x.jpg", "/a/b/x.jpg", true},
+		{"**/x.jpg", "x.jpg", true},
+		{"/**/x.jpg", "/x.jpg", true},
+		{"/**/x.jpg", "/a/b/x.jpg", true},
+		{"/**/x.jpg", "/a/b/y.jpg", false},
+		// "**" in the middle.
+		{"/a/**/x.jpg", "/a/x.jpg", true},
+		{"/a/**/x.jpg", "/a/b/c/x.jpg", true},
+		{"/a/**/x.jpg", "/b/c/x.jpg", false},
+		{"a/**/c/*.jpg", "/r/a/b/b/c/x.jpg", true},
+		{"a/**/c/*.jpg", "/r/a/b/b/d/x.jpg", false},
+		// "**" at the end.
+		{"/a/**", "/a", true},
+		{"/a/**", "/a/b/c", true},
+		{"/a/**", "/b/a", false},
+		{"cache/**", "/x/cache/y/z", true},
+		{"cache/**", "/x/cached/y", false},
+		// "*" does not cross segments.
+		{"/a/*", "/a/b/c", false},
+		{"*/c", "/a/b/c", true},
+		// Malformed patterns match nothing.
+		{"[", "[", false},
+		{"a/[b", "/a/[b", false},
+		{"**/[", "/x/[", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, filepath.FromSlash(tt.path)); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCheckGlobs(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		wantErr  bool
+	}{
+		{nil, false},
+		{[]string{"*.jpg", "/a/**/b", "[abc]?"}, false},
+		{[]string{"*.jpg", "["}, true},
+		{[]string{"a/[b/c"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkGlobs(tt.patterns); (err != nil) != tt.wantErr {
+			t.Errorf("checkGlobs(%q) = %v, want error: %v", tt.patterns, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExcludedDir(t *testing.T) {
+	tests := []struct {
+		exclude []string
+		path    string
+		want    bool
+	}{
+		// The directory itself matches.
+		{[]string{"cache"}, "/x/cache", true},
+		{[]string{"/x/cache"}, "/x/cache", true},
+		{[]string{"/cache"}, "/x/cache", false},
+		// The pattern matches everything in the directory.
+		{[]string{"*/cache/*"}, "/x/cache", true},
+		{[]string{"*/cache/*"}, "/x/y/cache", true},
+		{[]string{"*/cache/*"}, "cache", false},
+		{[]string{"cache/**"}, "/x/cache", true},
+		{[]string{"/x/**"}, "/x", true},
+		{[]string{"/x/**"}, "/y/x", false},
+		// It only matches some of the files in it.
+		{[]string{"*/cache/*.tmp"}, "/x/cache", false},
+		{[]string{"*/cache/*"}, "/x/cached", false},
+		{[]string{"*.tmp"}, "/x/cache", false},
+		// Any of several patterns.
+		{[]string{"*.tmp", "*/cache/*"}, "/x/cache", true},
+		{nil, "/x/cache", false},
+	}
+	for _, tt := range tests {
+		ti := testTI(t, Config{Exclude: tt.exclude})
+		if got := ti.excludedDir(filepath.FromSlash(tt.path)); got != tt.want {
+			t.Errorf("excludedDir(%q) with -exclude %q = %v, want %v", tt.path, tt.exclude, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// DefaultHash is the checksum algorithm used if Config.Hash is empty.
+const DefaultHash = "blake2b"
+
+// Hashes lists the supported checksum algorithms.
+var Hashes = []string{"blake2b", "blake3", "sha256", "sha512", "xxh3"}
+
+// newHash returns a new hasher for the named algorithm.
+func newHash(name string) (hash.Hash, error) {
+	switch name {
+	case "blake2b":
+		return blake2b.New256(nil)
+	case "blake2b-384":
+		return blake2b.New384(nil)
+	case "blake2b-512":
+		return blake2b.New512(nil)
+	case "blake3":
+		return blake3.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "xxh3":
+		return xxh3.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", name)
+}
+
+// withBits returns the name of the variant of the named algorithm with
+// the given output size. Only blake2b supports sizes other than its
+// default of 256 bits.
+func withBits(name string, bits int) (string, error) {
+	if bits == 0 || bits == 256 && name == "blake2b" {
+		return name, nil
+	}
+	if name != "blake2b" {
+		return "", fmt.Errorf("output size can only be chosen for blake2b, not %q", name)
+	}
+	switch bits {
+	case 384, 512:
+		return fmt.Sprintf("%s-%d", name, bits), nil
+	}
+	return "", fmt.Errorf("unsupported blake2b output size %d, must be 256, 384 or 512", bits)
+}
+
+// collisionResistant reports whether the named algorithm is a
+// cryptographic hash, i.e. whether equal sums imply equal contents for
+// all practical purposes.
+func collisionResistant(name string) bool {
+	return name != "xxh3"
+}
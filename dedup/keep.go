@@ -0,0 +1,82 @@
+package dedup
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultKeep is the link target policy used if Config.Keep is empty.
+const DefaultKeep = "most-linked"
+
+// KeepPolicies lists the supported link target policies.
+var KeepPolicies = []string{"first", "most-linked", "newest", "oldest", "shortest-path", "longest-path"}
+
+func checkKeep(policy string) error {
+	for _, p := range KeepPolicies {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown keep policy %q", policy)
+}
+
+// pickTarget returns the index of the group member whose i-node should
+// survive, according to Config.Prefer and Config.Keep. Ties go to the
+// earlier member.
+func (ti *treeinfo) pickTarget(names []string, stats []fileMeta) int {
+	for _, prefix := range ti.cfg.Prefer {
+		for i, name := range names {
+			if underPrefix(name, prefix) {
+				ti.log.Info("Preferring link target", "path", name, "prefix", prefix)
+				return i
+			}
+		}
+	}
+	target := 0
+	for i, st := range stats {
+		t := stats[target]
+		var better bool
+		switch ti.cfg.Keep {
+		case "most-linked":
+			// Re-runs on partially deduplicated trees touch as little as
+			// possible this way.
+			better = st.Nlink > t.Nlink
+		case "newest":
+			better = st.Mtime.After(t.Mtime)
+		case "oldest":
+			better = st.Mtime.Before(t.Mtime)
+		case "shortest-path":
+			better = comparePaths(names[i], names[target]) < 0
+		case "longest-path":
+			better = comparePaths(names[i], names[target]) > 0
+		}
+		if better {
+			target = i
+		}
+	}
+	return target
+}
+
+// underPrefix reports whether path is prefix or inside it, comparing
+// whole path components, so "/data/a" does not match "/data/ab".
+func underPrefix(path, prefix string) bool {
+	prefix = filepath.Clean(prefix)
+	path = filepath.Clean(path)
+	if path == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// comparePaths orders paths by their number of components, so the file
+// highest in the tree comes first, and then by length.
+func comparePaths(a, b string) int {
+	ca := strings.Count(filepath.ToSlash(filepath.Clean(a)), "/")
+	cb := strings.Count(filepath.ToSlash(filepath.Clean(b)), "/")
+	return cmp.Or(cmp.Compare(ca, cb), cmp.Compare(len(a), len(b)))
+}
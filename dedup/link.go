@@ -0,0 +1,601 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dedupe links the members of each group in ti.Sums, using Config.Jobs
+// workers that each handle one group at a time. Since groups are
+// disjoint, no two workers touch the same file. Counters and Groups are
+// only updated with RWLock held.
+func (ti *treeinfo) dedupe() (uint64, error) {
+	var savings uint64
+	var firstErr error
+	ti.progbar = ti.newBar(ti.Sums.files(), "Cmp/Link")
+	groups := make(chan group)
+	failed := make(chan struct{})
+	var wg sync.WaitGroup
+	for range ti.cfg.Jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range groups {
+				s, err := ti.checkpointedGroup(g.sum, g.names)
+				ti.RWLock.Lock()
+				savings += s
+				if err != nil && firstErr == nil {
+					firstErr = err
+					close(failed)
+				}
+				ti.RWLock.Unlock()
+			}
+		}()
+	}
+	err := ti.Sums.groups(func(sum string, names []string) error {
+		// Only stop between groups, so a link is never left half done.
+		select {
+		case groups <- group{sum, names}:
+			return nil
+		case <-failed:
+			return errStopped
+		case <-ti.ctx.Done():
+			return ti.ctx.Err()
+		}
+	})
+	close(groups)
+	wg.Wait()
+	ti.progbar.close()
+	if firstErr != nil {
+		return savings, firstErr
+	}
+	return savings, err
+}
+
+// group is a checksum and the files having it.
+type group struct {
+	sum   string
+	names []string
+}
+
+// errStopped stops handing out groups after a dedupe worker failed.
+var errStopped = errors.New("stopped")
+
+// checkpointedGroup runs dedupeGroup for the group with the given sum,
+// unless the checkpoint says it has been done already. Completed groups
+// are added to the checkpoint.
+func (ti *treeinfo) checkpointedGroup(sum string, names []string) (uint64, error) {
+	ti.progbar.add(int64(len(names)))
+	ti.prog.done.Add(int64(len(names)))
+	if ti.checkpoint == nil || len(names) <= 1 {
+		return ti.dedupeGroup(sum, names)
+	}
+	hash, algo := ti.describeSum(sum)
+	key := algo + ":" + hash
+	if ti.checkpoint.has(key) {
+		ti.log.Debug("Group done according to checkpoint, skipping", "hash", hash)
+		ti.RWLock.Lock()
+		ti.ResumedGroups++
+		ti.RWLock.Unlock()
+		return 0, nil
+	}
+	s, err := ti.dedupeGroup(sum, names)
+	if err != nil || ti.ctx.Err() != nil {
+		// The group may not have been finished.
+		return s, err
+	}
+	if err := ti.checkpoint.add(key); err != nil {
+		return s, fmt.Errorf("could not update checkpoint: %w", err)
+	}
+	return s, nil
+}
+
+// dedupeGroup picks a link target for the files with the given sum and
+// links the others to it, unless the group is to be skipped.
+func (ti *treeinfo) dedupeGroup(sum string, names []string) (uint64, error) {
+	if len(names) == 0 || len(names) == 1 && ti.cfg.Store == "" {
+		return 0, nil
+	}
+	stats := make([]fileMeta, 0, len(names))
+	members := make([]string, 0, len(names))
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			ti.log.Warn("File vanished since checksumming, skipping it", "path", name)
+			ti.RWLock.Lock()
+			ti.Vanished++
+			ti.RWLock.Unlock()
+			continue
+		}
+		if err != nil {
+			return 0, &FatalError{Path: name, Op: "stat", Err: err}
+		}
+		if size, ok := ti.HashedSizes[name]; ok && fi.Size() != size {
+			// Its checksum no longer describes it, so it must not be
+			// linked to or replaced.
+			ti.log.Warn("File changed size since checksumming, skipping it", "path", name, "size", fi.Size(),
+				"checksummed_size", size)
+			ti.RWLock.Lock()
+			ti.Resized++
+			ti.RWLock.Unlock()
+			continue
+		}
+		st, err := statFile(name, fi)
+		if err != nil {
+			return 0, err
+		}
+		if ti.protected(name, st) {
+			ti.log.Info("Not touching protected file", "path", name)
+			continue
+		}
+		if !ti.cfg.AllowSpecialBits && st.Mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) != 0 {
+			ti.log.Warn("Not touching file with setuid, setgid or sticky bit", "path", name, "mode", st.Mode)
+			continue
+		}
+		stats = append(stats, st)
+		members = append(members, name)
+	}
+	if len(members) > 1 && stats[0].Size == 0 && !ti.cfg.LinkEmpty {
+		// Empty files share no data blocks, so linking them saves nothing
+		// and only piles up links on one i-node. Walks skip them already,
+		// but -verify-links and -apply-plan do not.
+		ti.log.Info("Skipping group of empty files, linking them saves no space", "files", len(members),
+			"first", members[0])
+		return 0, nil
+	}
+	if len(members) == 1 && ti.cfg.Store != "" {
+		return ti.storeSingle(sum, members[0], stats[0])
+	}
+	return ti.dedupeDevices(sum, members, stats)
+}
+
+// dedupeDevices dedupes the members of a group that remain after
+// dedupeGroup's checks. Files can only be linked within a filesystem, so
+// each device's share of the group is handled on its own. In the symlink
+// modes, the shares on the other devices are replaced with symlinks
+// instead, see symlinkAcross.
+func (ti *treeinfo) dedupeDevices(sum string, members []string, stats []fileMeta) (uint64, error) {
+	parts, partstats := split(members, stats, func(_ string, st fileMeta) uint64 { return st.ID.Dev })
+	if len(parts) > 1 {
+		ti.log.Debug("Group spans devices, deduplicating on each one separately", "files", len(members),
+			"devices", len(parts))
+	}
+	keep := ti.symlinkKeep(sum, partstats)
+	var savings uint64
+	for i := range parts {
+		if keep >= 0 && i != keep {
+			// Linking these first would only churn the disk, and count
+			// them twice.
+			continue
+		}
+		var s uint64
+		var err error
+		if ti.cfg.SameDirOnly {
+			s, err = ti.dedupeByDir(sum, parts[i], partstats[i])
+		} else {
+			s, err = ti.dedupeMembers(sum, parts[i], partstats[i])
+		}
+		savings += s
+		if err != nil {
+			return savings, err
+		}
+	}
+	if keep >= 0 {
+		s, err := ti.symlinkAcross(sum, keep, parts, partstats)
+		savings += s
+		if err != nil {
+			return savings, err
+		}
+	}
+	return savings, nil
+}
+
+// split partitions the members of a group by key, keeping their order
+// within each part.
+func split[K comparable](names []string, stats []fileMeta, key func(string, fileMeta) K) ([][]string, [][]fileMeta) {
+	var parts [][]string
+	var partstats [][]fileMeta
+	index := make(map[K]int)
+	for i, name := range names {
+		k := key(name, stats[i])
+		n, ok := index[k]
+		if !ok {
+			n = len(parts)
+			index[k] = n
+			parts = append(parts, nil)
+			partstats = append(partstats, nil)
+		}
+		parts[n] = append(parts[n], name)
+		partstats[n] = append(partstats[n], stats[i])
+	}
+	return parts, partstats
+}
+
+// dedupeByDir splits a group by directory, for Config.SameDirOnly, and
+// dedupes each part on its own. Members without a duplicate in their own
+// directory are left alone.
+func (ti *treeinfo) dedupeByDir(sum string, names []string, stats []fileMeta) (uint64, error) {
+	parts, partstats := split(names, stats, func(name string, _ fileMeta) string { return filepath.Dir(name) })
+	var savings uint64
+	for i := range parts {
+		if len(parts[i]) == 1 {
+			ti.log.Debug("No duplicate in the same directory, skipping", "path", parts[i][0])
+			ti.RWLock.Lock()
+			ti.CrossDirDupes++
+			ti.RWLock.Unlock()
+			continue
+		}
+		s, err := ti.dedupeMembers(sum, parts[i], partstats[i])
+		savings += s
+		if err != nil {
+			return savings, err
+		}
+	}
+	return savings, nil
+}
+
+// dedupeMembers picks a link target among the remaining members of a
+// group and links the others to it, unless the group is to be skipped.
+func (ti *treeinfo) dedupeMembers(sum string, names []string, stats []fileMeta) (uint64, error) {
+	if len(names) <= 1 {
+		return 0, nil
+	}
+	if strings.HasPrefix(sum, decompPrefix) && ti.cfg.Verify {
+		// Only files of the same size on disk can be identical, so they
+		// are linked among each other, and only reported otherwise.
+		parts, partstats := split(names, stats, func(_ string, st fileMeta) int64 { return st.Size })
+		if len(parts) > 1 {
+			var savings uint64
+			for i := range parts {
+				if i > 0 {
+					ti.reportDecompressed(parts[i][0], parts[0][0])
+				}
+				s, err := ti.dedupeMembers(sum, parts[i], partstats[i])
+				savings += s
+				if err != nil {
+					return savings, err
+				}
+			}
+			return savings, nil
+		}
+	}
+	target := ti.pickTarget(names, stats)
+	first := names[target]
+	size := stats[target].Size
+	ti.log.Debug("Chose link target", "path", first, "keep", ti.cfg.Keep, "nlink", stats[target].Nlink,
+		"mtime", stats[target].Mtime)
+	//nolint:gosec // File sizes are never negative
+	if ti.skipGroup(names, stats, target, uint64(len(names)-1)*uint64(size)) {
+		return 0, nil
+	}
+	if strings.HasPrefix(sum, decompPrefix) && !ti.cfg.Verify {
+		for i, name := range names {
+			if i != target {
+				ti.reportDecompressed(name, first)
+			}
+		}
+		return 0, nil
+	}
+	if ti.cfg.Store != "" {
+		var ok bool
+		var err error
+		names, stats, target, ok, err = ti.storeTarget(sum, names, stats, target)
+		if !ok || err != nil {
+			return 0, err
+		}
+	}
+	return ti.linkGroup(sum, names, stats, target)
+}
+
+// skipGroup reports whether the group is not to be linked to the member
+// at index target, because of Config.MinCount, Config.MinSavings or
+// Config.RequireSamePerms, and counts it as skipped if so. potential is
+// the space linking it would free.
+func (ti *treeinfo) skipGroup(names []string, stats []fileMeta, target int, potential uint64) bool {
+	first := names[target]
+	if len(names) < ti.cfg.MinCount {
+		ti.log.Debug("Group has too few files, skipping", "dest", first, "files", len(names))
+		ti.RWLock.Lock()
+		ti.FewGroups++
+		ti.FewForgone += potential
+		ti.RWLock.Unlock()
+		return true
+	}
+	if potential < ti.cfg.MinSavings {
+		ti.log.Debug("Group would free too little, skipping", "dest", first, "files", len(names),
+			"savings", potential)
+		ti.RWLock.Lock()
+		ti.SmallGroups++
+		ti.SmallForgone += potential
+		ti.RWLock.Unlock()
+		return true
+	}
+	if ti.cfg.RequireSamePerms && !ti.samePerms(names, stats, target) {
+		ti.RWLock.Lock()
+		ti.PermGroups++
+		ti.RWLock.Unlock()
+		return true
+	}
+	return false
+}
+
+// addGroup records that linked have been (or would be) linked to target,
+// for the reports. With Config.WarnMtime, it also logs those of them
+// whose mtime differed from the target's.
+func (ti *treeinfo) addGroup(sum, target string, linked, mtimediffs []string, size int64, savings uint64,
+	mtime time.Time,
+) {
+	if len(linked) > 0 {
+		hash, algo := ti.describeSum(sum)
+		ti.RWLock.Lock()
+		ti.Groups = append(ti.Groups, Group{
+			Hash:      hash,
+			Algorithm: algo,
+			Target:    target,
+			Linked:    linked,
+			Size:      size,
+			Savings:   savings,
+		})
+		ti.RWLock.Unlock()
+	}
+	if ti.cfg.WarnMtime && len(mtimediffs) > 0 {
+		ti.log.Warn("Files with differing mtimes now share the target's mtime", "dest", target,
+			"mtime", mtime, "paths", mtimediffs)
+	}
+}
+
+// linkGroup links the members of the group with the given sum to the one
+// at index target, and returns the space freed. The members must all be
+// on the same device. If the target runs out of links, the next member
+// becomes the target for the rest of the group.
+func (ti *treeinfo) linkGroup(sum string, names []string, stats []fileMeta, target int) (uint64, error) {
+	var savings, groupsavings uint64
+	var mtimediffs, linked []string
+	size := stats[target].Size
+	firstdev := stats[target].ID.Dev
+	nlink := stats[target].Nlink
+	crossdev := false
+	// flush records what has been linked to the current target.
+	flush := func() {
+		ti.addGroup(sum, names[target], linked, mtimediffs, size, groupsavings, stats[target].Mtime)
+		linked, mtimediffs, groupsavings = nil, nil, 0
+	}
+	// newTarget makes the member at index i the target for the rest of
+	// the group.
+	newTarget := func(i int) {
+		ti.log.Info("Link target has too many links, using a new one", "dest", names[target], "nlink", nlink,
+			"newdest", names[i])
+		flush()
+		target = i
+		nlink = stats[i].Nlink
+	}
+	for i, name := range names {
+		if i == target {
+			continue
+		}
+		if ti.ctx.Err() != nil {
+			break
+		}
+		first := names[target]
+		dev := stats[i].ID.Dev
+		if stats[i].ID == stats[target].ID {
+			ti.log.Debug("Already linked, skipping", "src", name, "dest", first, "inodenum", stats[i].ID.Ino)
+			continue
+		}
+		mtimediff := !stats[i].Mtime.Equal(stats[target].Mtime)
+		if mtimediff && ti.cfg.RequireSameMtime {
+			ti.log.Info("Not deduplicating files with differing mtimes", "src", name, "dest", first)
+			continue
+		}
+		if ti.cfg.Verify {
+			same, err := sameContents(first, name)
+			if err != nil {
+				ti.log.Error("Could not verify file contents, skipping group", "src", name, "dest", first, "error", err)
+				break
+			}
+			if !same && strings.HasPrefix(sum, decompPrefix) {
+				ti.reportDecompressed(name, first)
+				continue
+			}
+			if !same {
+				ti.log.Error("Files with identical checksums differ, skipping group", "src", name, "dest", first)
+				ti.RWLock.Lock()
+				ti.HashCollisions++
+				ti.RWLock.Unlock()
+				break
+			}
+		}
+		if ti.cfg.MaxLinks > 0 && !ti.cfg.Reflink && nlink >= ti.cfg.MaxLinks {
+			newTarget(i)
+			continue
+		}
+		if !ti.withinBudget(size) {
+			ti.log.Info("Would deduplicate, but -maxfreed has been reached", "src", name, "dest", first, "size", size)
+			continue
+		}
+		symlinked := false
+		if ti.cfg.DryRun {
+			ti.log.Info("Would deduplicate", "src", name, "dest", first, "size", size)
+		} else {
+			ti.log.Info("Deduping", "src", name, "dest", first, "size", size)
+			err := ti.replace(first, name)
+			if ti.cfg.UseSymlinks && !ti.cfg.Reflink && linkUnsupported(err) {
+				ti.log.Info("Cannot hard-link, replacing with symlink instead", "src", name, "dest", first,
+					"error", err)
+				err = ti.symlink(first, name)
+				symlinked = err == nil
+			}
+			if errors.Is(err, errors.ErrUnsupported) {
+				ti.log.Warn("Reflinking not supported, skipping", "src", name, "dest", first, "error", err)
+				continue
+			}
+			if errors.Is(err, syscall.EXDEV) {
+				// Same device ID, but still not linkable, e.g. across bind mounts.
+				ti.log.Warn("Not deduplicating across mount points", "src", name, "srcdev", dev,
+					"dest", first, "destdev", firstdev)
+				crossdev = true
+				continue
+			}
+			if errors.Is(err, syscall.EMLINK) {
+				newTarget(i)
+				continue
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				ti.log.Warn("File vanished while linking, skipping it", "src", name, "dest", first, "error", err)
+				ti.RWLock.Lock()
+				ti.Vanished++
+				ti.RWLock.Unlock()
+				continue
+			}
+			if err != nil {
+				return savings, err
+			}
+		}
+		if ti.audit != nil {
+			if err := ti.audit.add(name, first, size, ti.cfg.DryRun); err != nil {
+				return savings, fmt.Errorf("could not write audit log: %w", err)
+			}
+		}
+		if !symlinked {
+			nlink++
+		}
+		//nolint:gosec // We _really_ don't expect negative filesizes here,
+		// since we already check in the checksumming phase
+		savings += uint64(size)
+		groupsavings += uint64(size)
+		ti.prog.bytes.Add(size)
+		ti.RWLock.Lock()
+		ti.DupeCount++
+		if symlinked {
+			ti.Symlinked++
+		}
+		ti.DevSavings[dev] += uint64(size)
+		ti.addExtStats(name, uint64(size))
+		ti.changed(name)
+		ti.RWLock.Unlock()
+		linked = append(linked, name)
+		if mtimediff {
+			mtimediffs = append(mtimediffs, name)
+		}
+	}
+	flush()
+	if crossdev {
+		ti.RWLock.Lock()
+		ti.CrossDevGroups++
+		ti.RWLock.Unlock()
+	}
+	return savings, nil
+}
+
+// reportDecompressed logs that the file at name has the same decompressed
+// contents as the link target, but is not linked to it, see
+// Config.Decompress.
+func (ti *treeinfo) reportDecompressed(name, target string) {
+	msg := "Decompressed contents match, not linking without -verify"
+	if ti.cfg.Verify {
+		msg = "Decompressed contents match, but the files differ, not linking"
+	}
+	ti.log.Info(msg, "src", name, "dest", target)
+	ti.RWLock.Lock()
+	ti.Decompressed++
+	ti.RWLock.Unlock()
+}
+
+// withinBudget reports whether linking a file of the given size keeps the
+// space freed within Config.MaxFreed, and if so, counts it as freed. Links
+// that fail later are still counted, so the limit is never exceeded.
+func (ti *treeinfo) withinBudget(size int64) bool {
+	if ti.cfg.MaxFreed == 0 {
+		return true
+	}
+	//nolint:gosec // File sizes are never negative
+	usize := uint64(size)
+	ti.RWLock.Lock()
+	defer ti.RWLock.Unlock()
+	if ti.budgetUsed+usize > ti.cfg.MaxFreed {
+		ti.DeferredFiles++
+		ti.DeferredBytes += usize
+		return false
+	}
+	ti.budgetUsed += usize
+	return true
+}
+
+// replace makes name share its data with target, by reflinking if
+// configured and by hard-linking otherwise.
+func (ti *treeinfo) replace(target, name string) error {
+	if !ti.cfg.Reflink {
+		return replaceWithLink(target, name)
+	}
+	err := reflink(target, name)
+	if errors.Is(err, errors.ErrUnsupported) && ti.cfg.ReflinkFallback {
+		ti.log.Debug("Reflinking not supported, hard-linking instead", "src", name, "dest", target)
+		return replaceWithLink(target, name)
+	}
+	return err
+}
+
+// replaceWithLink replaces name with a hard link to target. The link is
+// made under a temp name first and then renamed over name, which is
+// atomic, so name always refers to either the old or the new file. A
+// crash can at most leave behind the temp name as an extra link.
+func replaceWithLink(target, name string) error {
+	return replaceWith(target, name, os.Link)
+}
+
+// replaceWithSymlink is like replaceWithLink, but makes name a symlink.
+func replaceWithSymlink(target, name string) error {
+	return replaceWith(target, name, os.Symlink)
+}
+
+// replaceWith replaces name with what link makes of target, by way of a
+// temp name, see replaceWithLink.
+func replaceWith(target, name string, link func(target, name string) error) error {
+	tmpname := name + tmpSuffix
+	err := link(target, tmpname)
+	if errors.Is(err, fs.ErrExist) {
+		// Left over from an earlier run. Since name exists, it is stale.
+		if err := os.Remove(tmpname); err != nil {
+			return fmt.Errorf("could not remove stale temp file: %w", err)
+		}
+		err = link(target, tmpname)
+	}
+	if err != nil {
+		return fmt.Errorf("could not link %s to %s: %w", name, target, err)
+	}
+	if err := os.Rename(tmpname, name); err != nil {
+		if rerr := os.Remove(tmpname); rerr != nil {
+			return fmt.Errorf("could not replace %s (%v), nor remove temp link: %w", name, err, rerr)
+		}
+		return fmt.Errorf("could not replace %s with link to %s: %w", name, target, err)
+	}
+	// Renaming onto another name of the same file is a no-op that leaves
+	// the temp name in place.
+	if err := os.Remove(tmpname); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not delete temp link: %w", err)
+	}
+	return nil
+}
+
+// samePerms reports whether all group members have the same owner, group
+// and mode as the target, and logs the first one that does not.
+func (ti *treeinfo) samePerms(names []string, stats []fileMeta, target int) bool {
+	t := stats[target]
+	for i, st := range stats {
+		if st.UID == t.UID && st.GID == t.GID && st.Mode == t.Mode {
+			continue
+		}
+		ti.log.Warn("Group members differ in owner or mode, skipping group",
+			"path", names[i], "uid", st.UID, "gid", st.GID, "mode", st.Mode,
+			"dest", names[target], "dest_uid", t.UID, "dest_gid", t.GID, "dest_mode", t.Mode)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"pkg.i-no.de/pkg/d2hl/internal/atomicfile"
+)
+
+// writeManifest writes the checksums of all files in ti.Sums to path, in
+// the format read by sha256sum -c, b2sum -c and b3sum -c. Files kept by
+// contents because of Config.SmallFile are hashed for it. The manifest
+// is written atomically, so an interrupted run leaves no partial one.
+func (ti *treeinfo) writeManifest(path string) error {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	tag := manifestTag(ti.cfg.Hash)
+	err := ti.Sums.groups(func(sum string, paths []string) error {
+		sum, err := ti.contentHash(sum)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			writeManifestLine(w, tag, sum, p)
+		}
+		return nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b.Bytes())
+}
+
+// manifestTag returns the algorithm name for tagged manifest lines, as
+// written by b2sum --tag, or "" if the plain format is unambiguous. b2sum
+// -c takes plain lines to be BLAKE2b-512 unless given -l, so the other
+// sizes need the tag.
+func manifestTag(hash string) string {
+	switch hash {
+	case "blake2b":
+		return "BLAKE2b-256"
+	case "blake2b-384":
+		return "BLAKE2b-384"
+	}
+	return ""
+}
+
+// writeManifestLine writes one manifest line, tagged with tag unless it
+// is empty. Like the coreutils tools, it escapes backslashes and newlines
+// in the path, and marks such lines with a leading backslash.
+func writeManifestLine(w *bufio.Writer, tag, sum, path string) {
+	if strings.ContainsAny(path, "\\\n\r") {
+		path = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(path)
+		w.WriteString("\\")
+	}
+	if tag != "" {
+		w.WriteString(tag + " (" + path + ") = " + sum + "\n")
+		return
+	}
+	w.WriteString(sum + "  " + path + "\n")
+}
@@ -0,0 +1,83 @@
+package dedup
+
+import (
+	"log/slog"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// memSampleInterval is how often the heap usage is sampled to find its
+// peak, see Config.MemStats.
+const memSampleInterval = 100 * time.Millisecond
+
+// memWatch tracks the peak heap usage of a run. It is updated by its own
+// sampling goroutine and at the end of each phase.
+type memWatch struct {
+	peak atomic.Uint64
+	log  *slog.Logger
+}
+
+// sample reads the current memory statistics and updates the peak.
+func (m *memWatch) sample() runtime.MemStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for {
+		peak := m.peak.Load()
+		if ms.HeapAlloc <= peak || m.peak.CompareAndSwap(peak, ms.HeapAlloc) {
+			break
+		}
+	}
+	return ms
+}
+
+// watch samples the heap usage every memSampleInterval until stop is
+// closed.
+func (m *memWatch) watch(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	t := time.NewTicker(memSampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.sample()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// logPhase logs the memory usage at the end of phase.
+func (m *memWatch) logPhase(phase string) {
+	ms := m.sample()
+	m.log.Info("Memory usage", "phase", phase, "heap", humanize.Bytes(ms.HeapAlloc),
+		"peak_heap", humanize.Bytes(m.peak.Load()), "heap_sys", humanize.Bytes(ms.HeapSys),
+		"sys", humanize.Bytes(ms.Sys), "gcs", ms.NumGC)
+}
+
+// phaseDone records how long phase took, and with Config.MemStats, logs
+// the memory usage.
+func (ti *treeinfo) phaseDone(phase string, elapsed time.Duration) {
+	ti.Durations[phase] = elapsed
+	if ti.mem != nil {
+		ti.mem.logPhase(phase)
+	}
+}
+
+// logSumStats logs how many distinct checksums there are, and the size of
+// the largest group, for Config.MemStats.
+func (ti *treeinfo) logSumStats() {
+	hashes, largest := 0, 0
+	err := ti.Sums.groups(func(_ string, paths []string) error {
+		hashes++
+		largest = max(largest, len(paths))
+		return nil
+	})
+	if err != nil {
+		ti.log.Warn("Could not count checksums", "error", err)
+		return
+	}
+	ti.log.Info("Checksum groups", "hashes", hashes, "files", ti.Sums.files(), "largest_group", largest)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// hashMapped is only implemented on Unix-like systems.
+func hashMapped(_ io.Writer, f *os.File, _ int64) (int64, error) {
+	return 0, fmt.Errorf("could not map %s: %w", f.Name(), errors.ErrUnsupported)
+}
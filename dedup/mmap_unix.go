@@ -0,0 +1,34 @@
+//go:build unix
+
+package dedup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+
+	"golang.org/x/sys/unix"
+)
+
+// hashMapped writes the first size bytes of f to h by memory-mapping
+// them. A fault while reading the mapping, e.g. because the file was
+// truncated, is returned as an error instead of crashing.
+func hashMapped(h io.Writer, f *os.File, size int64) (n int64, err error) {
+	if int64(int(size)) != size {
+		return 0, fmt.Errorf("file too large to map: %d bytes", size)
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Munmap(data)
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("fault while reading mapped file: %v", r)
+		}
+	}()
+	w, err := h.Write(data)
+	return int64(w), err
+}
@@ -0,0 +1,164 @@
+package dedup
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// groupStore is the sumStore for Config.LinkPairs and Config.ApplyPlan.
+// Each set of pairs sharing files, or planned group, is a group of its
+// own, even if others have the same checksum.
+type groupStore []group
+
+// add starts a new group, unless the last one has the same sum and only
+// one member so far.
+func (p *groupStore) add(sum, path string) error {
+	if n := len(*p); n > 0 && (*p)[n-1].sum == sum && len((*p)[n-1].names) == 1 {
+		(*p)[n-1].names = append((*p)[n-1].names, path)
+		return nil
+	}
+	*p = append(*p, group{sum: sum, names: []string{path}})
+	return nil
+}
+
+func (p *groupStore) files() int {
+	n := 0
+	for _, g := range *p {
+		n += len(g.names)
+	}
+	return n
+}
+
+func (p *groupStore) groups(fn func(sum string, paths []string) error) error {
+	for _, g := range *p {
+		if err := fn(g.sum, g.names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *groupStore) close() error {
+	return nil
+}
+
+// checkPairs checks whether the pairs of Config.LinkPairs are links of
+// each other, and returns those that are not, but could be, since their
+// checksums match. Pairs that cannot be linked are logged.
+func (ti *treeinfo) checkPairs() (*groupStore, error) {
+	h, err := newHash(ti.cfg.Hash)
+	if err != nil {
+		return nil, err
+	}
+	hr := &hasher{h: h, buf: make([]byte, ti.cfg.ReadBuffer)}
+	ti.prog.setPhase("verify", len(ti.cfg.LinkPairs))
+	var linked, differ, crossdev, missing int
+	var unlinked [][2]string
+	filesums := make(map[string]string)
+pairs:
+	for _, pair := range ti.cfg.LinkPairs {
+		if err := ti.ctx.Err(); err != nil {
+			return nil, err
+		}
+		ti.prog.done.Add(1)
+		var stats [2]fileMeta
+		for i, name := range pair {
+			fi, err := os.Stat(name)
+			if errors.Is(err, fs.ErrNotExist) {
+				ti.log.Warn("Listed file does not exist", "path", name)
+				missing++
+				continue pairs
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !fi.Mode().IsRegular() {
+				ti.log.Warn("Listed file is not a regular file", "path", name)
+				differ++
+				continue pairs
+			}
+			stats[i], err = statFile(name, fi)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case stats[0].ID == stats[1].ID:
+			ti.log.Debug("Files are linked already", "src", pair[1], "dest", pair[0])
+			linked++
+			continue
+		case stats[0].ID.Dev != stats[1].ID.Dev:
+			ti.log.Warn("Files are on different devices and cannot be linked", "src", pair[1], "dest", pair[0])
+			crossdev++
+			continue
+		case stats[0].Size != stats[1].Size:
+			ti.log.Warn("Files listed as links differ in size", "src", pair[1], "dest", pair[0])
+			differ++
+			continue
+		}
+		var sums [2]string
+		for i, name := range pair {
+			sums[i], stats[i].Size, err = ti.sumFile(name, 0, hr)
+			if err != nil {
+				ti.log.Warn("Could not checksum file", "path", name, "err", err)
+				ti.Unreadable = append(ti.Unreadable, name)
+				continue pairs
+			}
+		}
+		if sums[0] != sums[1] {
+			ti.log.Warn("Files listed as links differ", "src", pair[1], "dest", pair[0])
+			differ++
+			continue
+		}
+		ti.log.Info("Files listed as links are not linked", "src", pair[1], "dest", pair[0])
+		for i, name := range pair {
+			ti.HashedSizes[name] = stats[i].Size
+			filesums[filepath.Clean(name)] = sums[i]
+		}
+		unlinked = append(unlinked, pair)
+	}
+	ti.log.Info("Links verified", "pairs", len(ti.cfg.LinkPairs), "linked", linked, "unlinked", len(unlinked),
+		"differ", differ, "crossdev", crossdev, "missing", missing)
+	return mergePairs(unlinked, filesums), nil
+}
+
+// mergePairs makes a group of each set of pairs that share files, since
+// dedupe relies on groups being disjoint. sums holds the checksum of each
+// file, by cleaned path. Pairs sharing a file have the same checksum. The
+// files of a group are in the order in which they were first listed.
+func mergePairs(pairs [][2]string, sums map[string]string) *groupStore {
+	parent := make(map[string]string)
+	find := func(k string) string {
+		for parent[k] != k {
+			parent[k] = parent[parent[k]]
+			k = parent[k]
+		}
+		return k
+	}
+	var names []string
+	for _, pair := range pairs {
+		for _, name := range pair {
+			if k := filepath.Clean(name); parent[k] == "" {
+				parent[k] = k
+				names = append(names, name)
+			}
+		}
+		parent[find(filepath.Clean(pair[1]))] = find(filepath.Clean(pair[0]))
+	}
+	groups := &groupStore{}
+	index := make(map[string]int)
+	for _, name := range names {
+		k := filepath.Clean(name)
+		root := find(k)
+		i, ok := index[root]
+		if !ok {
+			i = len(*groups)
+			index[root] = i
+			*groups = append(*groups, group{sum: sums[k]})
+		}
+		(*groups)[i].names = append((*groups)[i].names, name)
+	}
+	return groups
+}
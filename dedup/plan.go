@@ -0,0 +1,231 @@
+package dedup
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"pkg.i-no.de/pkg/d2hl/internal/atomicfile"
+)
+
+// planVersion is the version of the plan format written by writePlan.
+// Plans of other versions are not applied.
+const planVersion = 1
+
+// plan is the file format of Config.ExportPlan and Config.ApplyPlan: the
+// groups a dry run would link, with the state each file was in, so that
+// files that have changed since can be skipped.
+type plan struct {
+	Version int         `json:"version"`
+	Created time.Time   `json:"created"`
+	Groups  []planGroup `json:"groups"`
+}
+
+type planGroup struct {
+	Hash      string     `json:"hash"`
+	Algorithm string     `json:"algorithm"`
+	Target    planFile   `json:"target"`
+	Linked    []planFile `json:"linked"`
+}
+
+type planFile struct {
+	Path  string    `json:"path"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	Dev   uint64    `json:"dev"`
+	Ino   uint64    `json:"ino"`
+}
+
+// plainFile is planFile without its JSON methods.
+type plainFile planFile
+
+// jsonFile is the JSON form of a planFile. JSON strings cannot hold paths
+// that are not valid UTF-8, so those are also kept in RawPath, which is
+// base64-encoded.
+type jsonFile struct {
+	plainFile
+	RawPath []byte `json:"path_b64,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (f planFile) MarshalJSON() ([]byte, error) {
+	v := jsonFile{plainFile: plainFile(f)}
+	if !utf8.ValidString(f.Path) {
+		v.RawPath = []byte(f.Path)
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *planFile) UnmarshalJSON(data []byte) error {
+	var v jsonFile
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*f = planFile(v.plainFile)
+	if v.RawPath != nil {
+		f.Path = string(v.RawPath)
+	}
+	return nil
+}
+
+// statPlanFile returns the current state of the file at path. Plans hold
+// absolute paths, so they can be applied from any directory.
+func statPlanFile(path string) (planFile, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return planFile{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return planFile{}, err
+	}
+	meta, err := statFile(path, fi)
+	if err != nil {
+		return planFile{}, err
+	}
+	return planFile{Path: path, Size: meta.Size, Mtime: meta.Mtime, Dev: meta.ID.Dev, Ino: meta.ID.Ino}, nil
+}
+
+// changed reports whether the file described by f is no longer the one
+// recorded in the plan as want.
+func (f planFile) changed(want planFile) bool {
+	return f.Dev != want.Dev || f.Ino != want.Ino || f.Size != want.Size || !f.Mtime.Equal(want.Mtime)
+}
+
+// writePlan writes the groups of a dry run to path, see Config.ExportPlan.
+func (ti *treeinfo) writePlan(path string) error {
+	p := plan{Version: planVersion, Created: time.Now(), Groups: []planGroup{}}
+	for _, g := range ti.Groups {
+		target, err := statPlanFile(g.Target)
+		if source, ok := ti.storeSources[g.Target]; ok && errors.Is(err, fs.ErrNotExist) {
+			// A dry run does not add files to the store, see
+			// storeTarget, so the file it would be made from is the
+			// target instead. Applying the plan with Store set adds it
+			// to the store then.
+			target, err = statPlanFile(source)
+		}
+		if err != nil {
+			return err
+		}
+		pg := planGroup{Hash: g.Hash, Algorithm: g.Algorithm, Target: target}
+		for _, name := range g.Linked {
+			f, err := statPlanFile(name)
+			if err != nil {
+				return err
+			}
+			pg.Linked = append(pg.Linked, f)
+		}
+		slices.SortFunc(pg.Linked, func(a, b planFile) int { return strings.Compare(a.Path, b.Path) })
+		p.Groups = append(p.Groups, pg)
+	}
+	slices.SortFunc(p.Groups, func(a, b planGroup) int {
+		if c := strings.Compare(a.Hash, b.Hash); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Target.Path, b.Target.Path)
+	})
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(data, '\n'))
+}
+
+// sumKey returns the Sums key for a checksum and algorithm as returned by
+// describeSum.
+func sumKey(hash, algo string) (string, error) {
+	switch {
+	case algo == "raw":
+		raw, err := hex.DecodeString(hash)
+		if err != nil {
+			return "", err
+		}
+		return rawPrefix + string(raw), nil
+	case algo == "size-mtime":
+		return metaPrefix + hash, nil
+	case strings.HasPrefix(algo, "decompressed-"):
+		return decompPrefix + hash, nil
+	}
+	return hash, nil
+}
+
+// readPlan reads the plan at path, see Config.ApplyPlan, and returns its
+// groups, without the files that have changed since it was made. The
+// target is the first member of each group.
+func (ti *treeinfo) readPlan(path string) (*groupStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	ti.log.Info("Applying plan", "path", path, "created", p.Created, "age", time.Since(p.Created).Round(time.Second),
+		"groups", len(p.Groups))
+	ti.prog.setPhase("plan", len(p.Groups))
+	groups := &groupStore{}
+	var stale, linked int
+	for _, pg := range p.Groups {
+		if err := ti.ctx.Err(); err != nil {
+			return nil, err
+		}
+		ti.prog.done.Add(1)
+		sum, err := sumKey(pg.Hash, pg.Algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("bad checksum in plan: %w", err)
+		}
+		if strings.HasPrefix(sum, decompPrefix) && !ti.cfg.Verify {
+			// Like in a normal run, such groups are only linked after
+			// comparing their contents on disk.
+			ti.log.Warn("Group was matched by decompressed contents, skipping it without Verify", "dest", pg.Target.Path)
+			continue
+		}
+		target, err := statPlanFile(pg.Target.Path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err != nil || target.changed(pg.Target) {
+			ti.log.Warn("Link target changed since the plan was made, skipping group", "dest", pg.Target.Path)
+			stale += len(pg.Linked)
+			continue
+		}
+		names := []string{target.Path}
+		ti.HashedSizes[target.Path] = target.Size
+		for _, want := range pg.Linked {
+			f, err := statPlanFile(want.Path)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			switch {
+			case err == nil && f.Dev == target.Dev && f.Ino == target.Ino:
+				ti.log.Debug("File is linked already", "src", want.Path, "dest", target.Path)
+				linked++
+			case err != nil || f.changed(want):
+				ti.log.Warn("File changed since the plan was made, skipping it", "src", want.Path, "dest", target.Path)
+				stale++
+			default:
+				names = append(names, f.Path)
+				ti.HashedSizes[f.Path] = f.Size
+			}
+		}
+		if len(names) > 1 {
+			*groups = append(*groups, group{sum: sum, names: names})
+		}
+	}
+	ti.log.Info("Plan checked", "groups", len(*groups), "files", groups.files()-len(*groups), "stale", stale,
+		"linked", linked)
+	return groups, nil
+}
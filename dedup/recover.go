@@ -0,0 +1,60 @@
+package dedup
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const tmpSuffix = ".tmpdedupe"
+
+// recoverTemps cleans up temp files left behind under root by an
+// interrupted run. If the original file exists, the temp file is either
+// an unused link or, from older versions, the already replaced original,
+// and stale either way. Otherwise, the temp file is moved back.
+func (ti *treeinfo) recoverTemps(root string) error {
+	var temps []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && strings.HasSuffix(path, tmpSuffix) {
+			temps = append(temps, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, tmpname := range temps {
+		orig := strings.TrimSuffix(tmpname, tmpSuffix)
+		fi, err := os.Lstat(orig)
+		switch {
+		case err == nil && fi.Mode().IsRegular():
+			if ti.cfg.DryRun {
+				ti.log.Info("Would remove stale temp file", "tmpname", tmpname, "path", orig)
+				continue
+			}
+			ti.log.Info("Removing stale temp file", "tmpname", tmpname, "path", orig)
+			if err := os.Remove(tmpname); err != nil {
+				return fmt.Errorf("could not remove stale temp file: %w", err)
+			}
+		case os.IsNotExist(err):
+			if ti.cfg.DryRun {
+				ti.log.Info("Would restore file from temp file", "tmpname", tmpname, "path", orig)
+				continue
+			}
+			ti.log.Info("Restoring file from temp file", "tmpname", tmpname, "path", orig)
+			if err := os.Rename(tmpname, orig); err != nil {
+				return fmt.Errorf("could not restore temp file: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("could not stat original of temp file %s: %w", tmpname, err)
+		default:
+			return fmt.Errorf("original of temp file %s is not a regular file, please investigate", tmpname)
+		}
+	}
+	return nil
+}
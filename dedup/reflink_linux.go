@@ -0,0 +1,37 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes name share the data extents of target using the FICLONE
+// ioctl. Both files keep their own i-node and metadata. If the
+// filesystem does not support this, the returned error wraps
+// errors.ErrUnsupported.
+func reflink(target, name string) error {
+	src, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.ENOTTY), errors.Is(err, syscall.EINVAL):
+		return fmt.Errorf("could not reflink %s to %s: %w (%v)", name, target, errors.ErrUnsupported, err)
+	case err != nil:
+		return fmt.Errorf("could not reflink %s to %s: %w", name, target, err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package dedup
+
+import (
+	"errors"
+	"fmt"
+)
+
+// reflink is only implemented on Linux.
+func reflink(target, name string) error {
+	return fmt.Errorf("could not reflink %s to %s: %w", name, target, errors.ErrUnsupported)
+}
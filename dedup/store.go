@@ -0,0 +1,251 @@
+package dedup
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// diskStoreBuffer is how many bytes of checksums and paths a diskStore
+// keeps in memory before writing them out as a sorted run.
+const diskStoreBuffer = 64 << 20
+
+// sumStore maps checksums to the paths of the files having them. Stores
+// are not safe for concurrent use.
+type sumStore interface {
+	// add records that the file at path has the given checksum.
+	add(sum, path string) error
+	// files returns the number of paths added.
+	files() int
+	// groups calls fn for each checksum with the paths having it, until fn
+	// returns an error. It may be called more than once.
+	groups(fn func(sum string, paths []string) error) error
+	// close releases the resources held by the store.
+	close() error
+}
+
+// newStore returns an in-memory store, or with Config.DBDir set, one
+// that keeps most of its data in temp files in that directory.
+func (ti *treeinfo) newStore() (sumStore, error) {
+	if ti.cfg.DBDir == "" {
+		return memStore{}, nil
+	}
+	dir, err := os.MkdirTemp(ti.cfg.DBDir, "d2hl-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create checksum store: %w", err)
+	}
+	return &diskStore{dir: dir, limit: diskStoreBuffer}, nil
+}
+
+type memStore map[string][]string
+
+func (m memStore) add(sum, path string) error {
+	m[sum] = append(m[sum], path)
+	return nil
+}
+
+func (m memStore) files() int {
+	n := 0
+	for _, paths := range m {
+		n += len(paths)
+	}
+	return n
+}
+
+func (m memStore) groups(fn func(sum string, paths []string) error) error {
+	for sum, paths := range m {
+		if err := fn(sum, paths); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memStore) close() error {
+	return nil
+}
+
+type record struct {
+	sum, path string
+}
+
+// diskStore collects records in memory until there are limit bytes of
+// them, then writes them to a run file sorted by checksum. The groups are
+// read back by merging all runs, so only one record per run and the
+// current group are held in memory.
+type diskStore struct {
+	dir   string
+	limit int
+	buf   []record
+	size  int
+	runs  []string
+	count int
+}
+
+func (d *diskStore) add(sum, path string) error {
+	d.buf = append(d.buf, record{sum, path})
+	d.size += len(sum) + len(path)
+	d.count++
+	if d.size >= d.limit {
+		return d.flush()
+	}
+	return nil
+}
+
+func (d *diskStore) files() int {
+	return d.count
+}
+
+// flush writes the buffered records to a new run file.
+func (d *diskStore) flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	sort.Slice(d.buf, func(i, j int) bool {
+		return d.buf[i].sum < d.buf[j].sum
+	})
+	name := filepath.Join(d.dir, fmt.Sprintf("run-%d", len(d.runs)))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range d.buf {
+		writeString(w, r.sum)
+		writeString(w, r.path)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	d.runs = append(d.runs, name)
+	d.buf = d.buf[:0]
+	d.size = 0
+	return nil
+}
+
+// writeString writes s with a length prefix. Write errors are sticky and
+// returned by w.Flush.
+func writeString(w *bufio.Writer, s string) {
+	var l [binary.MaxVarintLen64]byte
+	w.Write(l[:binary.PutUvarint(l[:], uint64(len(s)))])
+	w.WriteString(s)
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// run is a run file being merged, with its next record.
+type run struct {
+	f    *os.File
+	r    *bufio.Reader
+	next record
+}
+
+// advance reads the next record, and returns false at the end of the run.
+func (r *run) advance() (bool, error) {
+	sum, err := readString(r.r)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	path, err := readString(r.r)
+	if err != nil {
+		return false, fmt.Errorf("truncated checksum store: %w", err)
+	}
+	r.next = record{sum, path}
+	return true, nil
+}
+
+type runHeap []*run
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].next.sum < h[j].next.sum }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*run)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (d *diskStore) groups(fn func(sum string, paths []string) error) error {
+	if err := d.flush(); err != nil {
+		return err
+	}
+	var h runHeap
+	defer func() {
+		for _, r := range h {
+			r.f.Close()
+		}
+	}()
+	for _, name := range d.runs {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		r := &run{f: f, r: bufio.NewReader(f)}
+		ok, err := r.advance()
+		if err != nil || !ok {
+			f.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		h = append(h, r)
+	}
+	heap.Init(&h)
+	var sum string
+	var paths []string
+	for h.Len() > 0 {
+		r := h[0]
+		if r.next.sum != sum && len(paths) > 0 {
+			if err := fn(sum, paths); err != nil {
+				return err
+			}
+			paths = nil
+		}
+		sum = r.next.sum
+		paths = append(paths, r.next.path)
+		ok, err := r.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+			r.f.Close()
+		}
+	}
+	if len(paths) > 0 {
+		return fn(sum, paths)
+	}
+	return nil
+}
+
+func (d *diskStore) close() error {
+	return os.RemoveAll(d.dir)
+}
@@ -0,0 +1,62 @@
+package dedup
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// storeGroups returns the groups of s, with their paths sorted, and fails
+// if a checksum is passed to fn more than once.
+func storeGroups(t *testing.T, s sumStore) map[string][]string {
+	t.Helper()
+	groups := make(map[string][]string)
+	err := s.groups(func(sum string, paths []string) error {
+		if _, ok := groups[sum]; ok {
+			t.Errorf("checksum %q passed more than once", sum)
+		}
+		groups[sum] = slices.Sorted(slices.Values(paths))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return groups
+}
+
+// TestDiskStore adds the same records to a diskStore, with a buffer small
+// enough to make it write several runs, and to a memStore, and compares
+// their groups.
+func TestDiskStore(t *testing.T) {
+	mem := memStore{}
+	disk := &diskStore{dir: t.TempDir(), limit: 200}
+	const files, sums = 500, 37
+	for i := range files {
+		// Checksums of different lengths, so the runs are not all the
+		// same size, and groups of different sizes, some of one file.
+		sum := fmt.Sprintf("%0*x", 1+i%3, (i*i)%sums)
+		path := fmt.Sprintf("/tree/d%d/f%d", i%7, i)
+		for _, s := range []sumStore{mem, disk} {
+			if err := s.add(sum, path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(disk.runs) < 10 {
+		t.Fatalf("%d runs written, want at least 10", len(disk.runs))
+	}
+	if disk.files() != files || mem.files() != files {
+		t.Errorf("files() = %d (disk), %d (memory), want %d", disk.files(), mem.files(), files)
+	}
+	want := storeGroups(t, mem)
+	for i := range 2 {
+		// Groups can be read more than once.
+		if got := storeGroups(t, disk); !maps.EqualFunc(got, want, slices.Equal) {
+			t.Errorf("pass %d: groups = %v, want %v", i, got, want)
+		}
+	}
+	if err := disk.close(); err != nil {
+		t.Fatal(err)
+	}
+}
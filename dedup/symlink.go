@@ -0,0 +1,183 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// symlinkKeep returns the index of the part of a group, as split by
+// device, whose files are kept when the others are replaced with
+// symlinks. That is the part on the device of Config.SymlinkDevice, or
+// with Config.UseSymlinks, the first one. It returns -1 if the group is
+// not to be symlinked across devices.
+func (ti *treeinfo) symlinkKeep(sum string, partstats [][]fileMeta) int {
+	if len(partstats) <= 1 || strings.HasPrefix(sum, decompPrefix) {
+		// Decompressed matches may differ on disk, see dedupeMembers.
+		// setDefaults rejects this combination, this is only a safety
+		// net.
+		return -1
+	}
+	if ti.cfg.SymlinkDevice == "" {
+		if ti.cfg.UseSymlinks {
+			return 0
+		}
+		return -1
+	}
+	for i := range partstats {
+		if partstats[i][0].ID.Dev == ti.symlinkDev {
+			return i
+		}
+	}
+	return -1
+}
+
+// symlinkAcross replaces the members of a group on other devices than
+// that of part keep with symlinks to a member of part keep, see
+// symlinkKeep. Only part keep has been linked already, so each replaced
+// file's space is freed once its last name is gone. The group is
+// filtered and accounted for like in linkGroup.
+func (ti *treeinfo) symlinkAcross(sum string, keep int, parts [][]string, partstats [][]fileMeta) (uint64, error) {
+	t := ti.pickTarget(parts[keep], partstats[keep])
+	target, err := filepath.Abs(parts[keep][t])
+	if err != nil {
+		return 0, err
+	}
+	// The group as seen from here: the target, then the members on the
+	// other devices.
+	names := []string{target}
+	stats := []fileMeta{partstats[keep][t]}
+	for i := range parts {
+		if i != keep {
+			names = append(names, parts[i]...)
+			stats = append(stats, partstats[i]...)
+		}
+	}
+	size := stats[0].Size
+	//nolint:gosec // File sizes are never negative
+	if ti.skipGroup(names, stats, 0, uint64(len(names)-1)*uint64(size)) {
+		return 0, nil
+	}
+	var savings uint64
+	var linked, mtimediffs []string
+	defer func() {
+		ti.addGroup(sum, target, linked, mtimediffs, size, savings, stats[0].Mtime)
+	}()
+	// In a dry run, a file would be freed once all of its names were
+	// replaced.
+	replaced := make(map[fileID]uint64)
+	for i, name := range names {
+		if i == 0 {
+			continue
+		}
+		if ti.ctx.Err() != nil {
+			break
+		}
+		st := stats[i]
+		nlink := st.Nlink
+		mtimediff := !st.Mtime.Equal(stats[0].Mtime)
+		if mtimediff && ti.cfg.RequireSameMtime {
+			ti.log.Info("Not deduplicating files with differing mtimes", "src", name, "dest", target)
+			continue
+		}
+		if ti.cfg.Verify {
+			same, err := sameContents(target, name)
+			if err != nil {
+				ti.log.Error("Could not verify file contents, not symlinking", "src", name, "dest", target, "error", err)
+				break
+			}
+			if !same {
+				ti.log.Error("Files with identical checksums differ, not symlinking", "src", name, "dest", target)
+				ti.RWLock.Lock()
+				ti.HashCollisions++
+				ti.RWLock.Unlock()
+				break
+			}
+		}
+		if !ti.withinBudget(size) {
+			ti.log.Info("Would replace with symlink across devices, but -maxfreed has been reached",
+				"src", name, "dest", target, "size", size)
+			continue
+		}
+		if ti.cfg.DryRun {
+			ti.log.Info("Would replace with symlink across devices", "src", name, "dest", target, "size", size)
+			replaced[st.ID]++
+		} else {
+			fi, err := os.Stat(name)
+			if errors.Is(err, fs.ErrNotExist) {
+				ti.log.Warn("File vanished while symlinking, skipping it", "src", name, "dest", target)
+				continue
+			}
+			if err != nil {
+				return savings, fmt.Errorf("could not stat file for symlinking: %w", err)
+			}
+			cur, err := statFile(name, fi)
+			if err != nil {
+				return savings, err
+			}
+			nlink = cur.Nlink
+			ti.log.Info("Replacing with symlink across devices", "src", name, "dest", target, "size", size)
+			if err := ti.symlink(target, name); err != nil {
+				return savings, err
+			}
+		}
+		if ti.audit != nil {
+			if err := ti.audit.add(name, target, size, ti.cfg.DryRun); err != nil {
+				return savings, fmt.Errorf("could not write audit log: %w", err)
+			}
+		}
+		freed := nlink == 1
+		if ti.cfg.DryRun {
+			freed = replaced[st.ID] == nlink
+		}
+		ti.RWLock.Lock()
+		ti.DupeCount++
+		ti.Symlinked++
+		if freed {
+			//nolint:gosec // File sizes are never negative
+			savings += uint64(size)
+			ti.prog.bytes.Add(size)
+			ti.DevSavings[st.ID.Dev] += uint64(size)
+			//nolint:gosec // File sizes are never negative
+			ti.addExtStats(name, uint64(size))
+		}
+		ti.changed(name)
+		ti.RWLock.Unlock()
+		linked = append(linked, name)
+		if mtimediff {
+			mtimediffs = append(mtimediffs, name)
+		}
+	}
+	return savings, nil
+}
+
+// symlink replaces name with a symlink to target, which is relative with
+// Config.UseSymlinks and absolute otherwise.
+func (ti *treeinfo) symlink(target, name string) error {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	if !ti.cfg.UseSymlinks {
+		return replaceWithSymlink(abs, name)
+	}
+	absname, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(filepath.Dir(absname), abs)
+	if err != nil {
+		return err
+	}
+	return replaceWithSymlink(rel, name)
+}
+
+// linkUnsupported reports whether err means that a hard link could not be
+// made, but a symlink might work, see Config.UseSymlinks.
+func linkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP)
+}
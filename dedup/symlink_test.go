@@ -0,0 +1,120 @@
+package dedup
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testTI returns a treeinfo for cfg, as Run would set it up.
+func testTI(tb testing.TB, cfg Config) *treeinfo {
+	tb.Helper()
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := cfg.setDefaults(); err != nil {
+		tb.Fatal(err)
+	}
+	ti := newTI()
+	ti.cfg = cfg
+	ti.ctx = context.Background()
+	ti.log = cfg.Logger
+	return &ti
+}
+
+// TestSymlinkAcross dedupes a group spread over three devices with
+// -use-symlinks, faking the device IDs, and checks that each file is
+// replaced and counted once.
+func TestSymlinkAcross(t *testing.T) {
+	contents := []byte("the same contents\n")
+	size := uint64(len(contents))
+	for _, dryrun := range []bool{false, true} {
+		t.Run(map[bool]string{false: "real", true: "dryrun"}[dryrun], func(t *testing.T) {
+			root := t.TempDir()
+			// The files and the device each is made to be on.
+			files := []struct {
+				name string
+				dev  uint64
+			}{{"a", 1}, {"b", 1}, {"c", 2}, {"d", 2}, {"e", 3}}
+			var names []string
+			var stats []fileMeta
+			for _, f := range files {
+				name := filepath.Join(root, f.name)
+				if err := os.WriteFile(name, contents, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				fi, err := os.Stat(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				st, err := statFile(name, fi)
+				if err != nil {
+					t.Fatal(err)
+				}
+				st.ID.Dev = f.dev
+				names = append(names, name)
+				stats = append(stats, st)
+			}
+
+			ti := testTI(t, Config{Roots: []string{root}, UseSymlinks: true, DryRun: dryrun})
+			savings, err := ti.dedupeDevices("sum", names, stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := 4 * size; savings != want {
+				t.Errorf("savings = %d, want %d", savings, want)
+			}
+			if ti.DupeCount != 4 {
+				t.Errorf("DupeCount = %d, want 4", ti.DupeCount)
+			}
+			if ti.Symlinked != 3 {
+				t.Errorf("Symlinked = %d, want 3", ti.Symlinked)
+			}
+			wantDev := map[uint64]uint64{1: size, 2: 2 * size, 3: size}
+			for dev, want := range wantDev {
+				if got := ti.DevSavings[dev]; got != want {
+					t.Errorf("DevSavings[%d] = %d, want %d", dev, got, want)
+				}
+			}
+			if len(ti.Groups) != 2 {
+				t.Fatalf("got %d groups, want 2: %+v", len(ti.Groups), ti.Groups)
+			}
+			var linked []string
+			var groupsavings uint64
+			for _, g := range ti.Groups {
+				if g.Target != names[0] {
+					t.Errorf("group target = %s, want %s", g.Target, names[0])
+				}
+				linked = append(linked, g.Linked...)
+				groupsavings += g.Savings
+			}
+			slices.Sort(linked)
+			if want := names[1:]; !slices.Equal(linked, want) {
+				t.Errorf("linked files = %v, want %v", linked, want)
+			}
+			if groupsavings != savings {
+				t.Errorf("groups' savings add up to %d, want %d", groupsavings, savings)
+			}
+
+			for _, name := range names[2:] {
+				fi, err := os.Lstat(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if symlinked := fi.Mode()&os.ModeSymlink != 0; symlinked == dryrun {
+					t.Errorf("%s is a symlink: %v, want %v", name, symlinked, !dryrun)
+				}
+				got, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(contents) {
+					t.Errorf("%s has contents %q, want %q", name, got, contents)
+				}
+			}
+		})
+	}
+}
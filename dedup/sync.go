@@ -0,0 +1,33 @@
+package dedup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// changed records that name was replaced, so its directory is synced
+// with Config.Sync. The caller must hold RWLock.
+func (ti *treeinfo) changed(name string) {
+	if ti.cfg.Sync && !ti.cfg.DryRun {
+		ti.changedDirs[filepath.Dir(name)] = true
+	}
+}
+
+// syncDirs fsyncs the directories in which files were replaced, so the
+// new links survive a crash.
+func (ti *treeinfo) syncDirs() error {
+	var errs []error
+	for dir := range ti.changedDirs {
+		f, err := os.Open(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+		f.Close()
+	}
+	return errors.Join(errs...)
+}
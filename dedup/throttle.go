@@ -0,0 +1,69 @@
+package dedup
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most a throttled reader reads at once, so that
+// workers take turns in small steps instead of large bursts.
+const throttleChunk = 64 * 1024
+
+// throttle limits the combined read rate of all readers sharing it.
+type throttle struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+func newThrottle(bytesPerSec int64) *throttle {
+	return &throttle{rate: float64(bytesPerSec)}
+}
+
+// wait accounts for n bytes having been read, and blocks until the
+// aggregate rate is back under the limit or ctx is done.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+	until := t.next
+	t.mu.Unlock()
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *throttle
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := tr.r.Read(p)
+	if werr := tr.t.wait(tr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// reader returns r, rate limited if Config.MaxRead is set.
+func (ti *treeinfo) reader(r io.Reader) io.Reader {
+	if ti.throttle == nil {
+		return r
+	}
+	return throttledReader{ctx: ti.ctx, r: r, t: ti.throttle}
+}
@@ -0,0 +1,46 @@
+package dedup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+const verifyBufSize = 64 * 1024
+
+// sameContents reports whether the files at a and b are byte-for-byte
+// identical.
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufa := make([]byte, verifyBufSize)
+	bufb := make([]byte, verifyBufSize)
+	for {
+		na, erra := io.ReadFull(fa, bufa)
+		nb, errb := io.ReadFull(fb, bufb)
+		eofa := errors.Is(erra, io.EOF) || errors.Is(erra, io.ErrUnexpectedEOF)
+		eofb := errors.Is(errb, io.EOF) || errors.Is(errb, io.ErrUnexpectedEOF)
+		if erra != nil && !eofa {
+			return false, erra
+		}
+		if errb != nil && !eofb {
+			return false, errb
+		}
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if eofa || eofb {
+			return eofa == eofb, nil
+		}
+	}
+}
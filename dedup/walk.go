@@ -0,0 +1,449 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// process is the fs.WalkDirFunc used to enumerate candidate files. It only
+// stats entries that are regular files and pass the name-based filters.
+// It is safe for concurrent use, see treeinfo for the locking rules.
+func (ti *treeinfo) process(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := ti.ctx.Err(); err != nil {
+		return err
+	}
+	if d.IsDir() && ti.excludedDir(path) {
+		ti.log.Debug("Skipping excluded directory", "path", path)
+		return filepath.SkipDir
+	}
+	if d.IsDir() && ti.cfg.SkipVCS && isVCSDir(path) {
+		return ti.skipVCSDir(path)
+	}
+	if d.IsDir() && ti.tooDeep(path) {
+		ti.log.Debug("Skipping directory below -maxdepth", "path", path)
+		return filepath.SkipDir
+	}
+	if d.IsDir() && ti.cfg.FollowSymlinks {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !ti.firstVisit(path, info) {
+			ti.log.Debug("Skipping already visited directory", "path", path)
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if d.Type()&fs.ModeSymlink != 0 && ti.cfg.FollowSymlinks {
+		return ti.followSymlink(path)
+	}
+	if d.IsDir() {
+		return nil
+	}
+	if !d.Type().IsRegular() {
+		ti.skipSpecial(path, d.Type())
+		return nil
+	}
+	if ti.cfg.NoDotFiles && strings.HasPrefix(d.Name(), ".") {
+		return nil
+	}
+	if !ti.includedFile(path) {
+		return nil
+	}
+	info, err := d.Info()
+	if errors.Is(err, fs.ErrNotExist) {
+		ti.log.Debug("File vanished during walk", "path", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ti.addFile(path, info)
+}
+
+// errUnreadable is returned by statFile for files that cannot be opened
+// to get their ID. They are skipped like files that cannot be checksummed.
+var errUnreadable = errors.New("could not open file")
+
+// addFile records the regular file at path as a candidate, unless it is
+// outside the size limits or its i-node has been seen before.
+func (ti *treeinfo) addFile(path string, info fs.FileInfo) error {
+	if ok, err := ti.filterFile(path, info); !ok || err != nil {
+		return err
+	}
+	// On Windows, this opens the file, so it is done without the lock.
+	meta, err := statFile(path, info)
+	if errors.Is(err, errUnreadable) {
+		ti.log.Warn("Could not get file ID, skipping it", "path", path, "error", err)
+		ti.RWLock.Lock()
+		ti.Unreadable = append(ti.Unreadable, path)
+		ti.RWLock.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sz := info.Size()
+	ti.RWLock.Lock()
+	defer ti.RWLock.Unlock()
+	ti.log.Debug("Found file", "path", path, "dev", meta.ID.Dev, "ino", meta.ID.Ino)
+	if ti.Inodes[meta.ID] {
+		ti.log.Debug("We have already seen this i-node, skipping the file", "inodenum", meta.ID.Ino)
+		ti.ExistingLinks++
+		return nil
+	}
+	ti.Inodes[meta.ID] = true
+	ds := ti.DevStats[meta.ID.Dev]
+	if ds == nil {
+		ds = &devStats{}
+		ti.DevStats[meta.ID.Dev] = ds
+	}
+	ds.Files++
+	ds.Bytes += uint64(sz)
+	// Files can only be identical if they have the same size, and only
+	// be linked on the same device, so we bucket them here and only
+	// checksum buckets with multiple members. Copies on other devices are
+	// only of interest if they can be replaced with symlinks.
+	key := sizeKey{Dev: meta.ID.Dev, Size: sz}
+	if ti.cfg.SymlinkDevice != "" || ti.cfg.UseSymlinks {
+		key.Dev = 0
+	}
+	if ti.compressed(path) {
+		key.Size = compressedSize
+		ti.Sizes[path] = sz
+	}
+	ti.SizeGroups[key] = append(ti.SizeGroups[key], path)
+	return nil
+}
+
+// filterFile reports whether the regular file at path passes the size
+// and time limits, and counts it as found if so, or as skipped.
+func (ti *treeinfo) filterFile(path string, info fs.FileInfo) (bool, error) {
+	ti.RWLock.Lock()
+	defer ti.RWLock.Unlock()
+	sz := info.Size()
+	if sz < 0 {
+		return false, &FatalError{Path: path, Op: "walk", Err: fmt.Errorf("found file with negative size %d, please investigate", sz)}
+	}
+	if sz == 0 && !ti.cfg.LinkEmpty {
+		ti.EmptySkipped++
+		return false, nil
+	}
+	if uint64(sz) < ti.cfg.MinSize || (ti.cfg.MaxSize > 0 && uint64(sz) >= ti.cfg.MaxSize) {
+		ti.SizeSkipped++
+		return false, nil
+	}
+	if strings.HasSuffix(path, tmpSuffix) {
+		if ti.cfg.Recover {
+			// Only left over in dry runs, recoverTemps has logged it.
+			return false, nil
+		}
+		if fi, err := os.Lstat(strings.TrimSuffix(path, tmpSuffix)); err == nil && fi.Mode().IsRegular() {
+			// The original is still there, so the temp file is only an
+			// extra name and safe to ignore.
+			ti.log.Warn("Ignoring leftover temp file from previous run, use -recover to remove it", "path", path)
+			return false, nil
+		}
+		return false, &FatalError{Path: path, Op: "walk", Err: errors.New("leftover file from previous run without its original, please investigate or enable recovery")}
+	}
+	if ti.cfg.SkipRecent > 0 && time.Since(info.ModTime()) < ti.cfg.SkipRecent {
+		ti.log.Info("Skipping recently modified file", "path", path, "mtime", info.ModTime())
+		ti.RecentSkipped++
+		return false, nil
+	}
+	if !ti.cfg.OlderThan.IsZero() && info.ModTime().After(ti.cfg.OlderThan) {
+		ti.log.Debug("Skipping file modified after cutoff", "path", path, "mtime", info.ModTime())
+		ti.NewerSkipped++
+		return false, nil
+	}
+	ti.FileCount++
+	ti.prog.done.Add(1)
+	return true, nil
+}
+
+// addListed enumerates Config.Files instead of walking the roots. The
+// files are filtered as if process had come across them.
+func (ti *treeinfo) addListed() error {
+	for _, path := range ti.cfg.Files {
+		if err := ti.ctx.Err(); err != nil {
+			return err
+		}
+		info, err := os.Lstat(path)
+		if err == nil && info.Mode()&fs.ModeSymlink != 0 && ti.cfg.FollowSymlinks {
+			path, err = filepath.EvalSymlinks(path)
+			if err == nil {
+				info, err = os.Stat(path)
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			ti.log.Warn("Listed file does not exist, skipping it", "path", path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			ti.log.Debug("Listed path is not a regular file, skipping it", "path", path)
+			if !info.IsDir() {
+				ti.skipSpecial(path, info.Mode())
+			}
+			continue
+		}
+		if ti.cfg.NoDotFiles && strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if dir := vcsDirOf(path); ti.cfg.SkipVCS && dir != "" {
+			//nolint:errcheck // Only SkipDir, which does not apply here
+			ti.skipVCSDir(dir)
+			continue
+		}
+		if !ti.includedFile(path) {
+			continue
+		}
+		if err := ti.addFile(path, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk enumerates root, using ti.cfg.Walkers concurrent walkers if that
+// is more than one.
+func (ti *treeinfo) walk(root string) error {
+	if ti.cfg.MaxDepth > 0 {
+		ti.setDepthBase(root, 0)
+	}
+	if ti.cfg.Walkers <= 1 {
+		ti.descend = func(dir string) error {
+			return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if path == dir && err == nil {
+					// followSymlink has already checked and marked it.
+					return nil
+				}
+				return ti.process(path, d, err)
+			})
+		}
+		return filepath.WalkDir(root, ti.process)
+	}
+	q := newDirQueue()
+	ti.descend = func(dir string) error {
+		q.push(dir)
+		return nil
+	}
+	info, err := os.Lstat(root)
+	if err != nil {
+		return ti.process(root, nil, err)
+	}
+	d := fs.FileInfoToDirEntry(info)
+	err = ti.process(root, d, nil)
+	if errors.Is(err, filepath.SkipDir) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if d.IsDir() {
+		q.push(root)
+	}
+	var wg sync.WaitGroup
+	for range ti.cfg.Walkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir, ok := q.pop(); ok; dir, ok = q.pop() {
+				q.done(ti.walkDir(dir, q))
+			}
+		}()
+	}
+	wg.Wait()
+	return q.err
+}
+
+// walkDir processes the entries of a single directory and queues its
+// subdirectories for the other walkers. Unlike filepath.WalkDir, entries
+// are processed in no particular order.
+func (ti *treeinfo) walkDir(dir string, q *dirQueue) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		err := ti.process(path, e, nil)
+		if errors.Is(err, filepath.SkipDir) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			q.push(path)
+		}
+	}
+	return nil
+}
+
+// followSymlink resolves the symlink at path. Directories are walked
+// unless they have been visited before, which also breaks symlink loops.
+// Regular files are added under their resolved path, so they can be
+// deduplicated against other copies.
+func (ti *treeinfo) followSymlink(path string) error {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		ti.log.Debug("Skipping unresolvable symlink", "path", path, "error", err)
+		return nil
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		ti.log.Debug("Skipping unresolvable symlink", "path", path, "error", err)
+		return nil
+	}
+	switch {
+	case info.IsDir():
+		if ti.excludedDir(real) {
+			ti.log.Debug("Skipping excluded directory", "path", real, "symlink", path)
+			return nil
+		}
+		if ti.tooDeep(path) {
+			ti.log.Debug("Skipping directory below -maxdepth", "path", real, "symlink", path)
+			return nil
+		}
+		if ti.cfg.SkipVCS && (isVCSDir(path) || isVCSDir(real)) {
+			//nolint:errcheck // Only SkipDir, which does not apply here
+			ti.skipVCSDir(real)
+			return nil
+		}
+		if !ti.firstVisit(real, info) {
+			ti.log.Debug("Skipping already visited directory", "path", real, "symlink", path)
+			return nil
+		}
+		if ti.cfg.MaxDepth > 0 {
+			ti.setDepthBase(real, ti.depth(path))
+		}
+		return ti.descend(real)
+	case info.Mode().IsRegular():
+		if ti.cfg.NoDotFiles && strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		if !ti.includedFile(real) {
+			return nil
+		}
+		return ti.addFile(real, info)
+	}
+	ti.skipSpecial(real, info.Mode())
+	return nil
+}
+
+// setDepthBase records that the walk of dir starts at the given level,
+// for Config.MaxDepth.
+func (ti *treeinfo) setDepthBase(dir string, level int) {
+	ti.RWLock.Lock()
+	defer ti.RWLock.Unlock()
+	ti.DepthBases[dir] = level
+}
+
+// depth returns how many levels below a root the directory at path is,
+// counting from the closest directory a walk started at.
+func (ti *treeinfo) depth(path string) int {
+	ti.RWLock.RLock()
+	defer ti.RWLock.RUnlock()
+	level := -1
+	for base, baselevel := range ti.DepthBases {
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		l := baselevel
+		if rel != "." {
+			l += strings.Count(rel, string(filepath.Separator)) + 1
+		}
+		if level < 0 || l < level {
+			level = l
+		}
+	}
+	return max(level, 0)
+}
+
+// tooDeep reports whether the directory at path is too far below its
+// root to be walked, see Config.MaxDepth.
+func (ti *treeinfo) tooDeep(path string) bool {
+	return ti.cfg.MaxDepth > 0 && ti.depth(path) >= ti.cfg.MaxDepth
+}
+
+// firstVisit marks the directory at path, described by info, as visited,
+// and reports whether it had not been visited before.
+func (ti *treeinfo) firstVisit(path string, info fs.FileInfo) bool {
+	meta, err := statFile(path, info)
+	if err != nil {
+		return true
+	}
+	ti.RWLock.Lock()
+	defer ti.RWLock.Unlock()
+	if ti.Dirs[meta.ID] {
+		return false
+	}
+	ti.Dirs[meta.ID] = true
+	return true
+}
+
+// dirQueue hands out directories to concurrent walkers. It keeps track of
+// directories that are still being read, since those may add more work.
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    []string
+	pending int
+	err     error
+}
+
+func newDirQueue() *dirQueue {
+	q := &dirQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(dir string) {
+	q.mu.Lock()
+	q.dirs = append(q.dirs, dir)
+	q.pending++
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop returns the next directory to read. It returns false once all
+// directories have been read or an error occurred.
+func (q *dirQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.dirs) == 0 && q.pending > 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil || len(q.dirs) == 0 {
+		return "", false
+	}
+	dir := q.dirs[len(q.dirs)-1]
+	q.dirs = q.dirs[:len(q.dirs)-1]
+	return dir, true
+}
+
+// done marks a directory returned by pop as finished.
+func (q *dirQueue) done(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	if q.pending == 0 || q.err != nil {
+		q.cond.Broadcast()
+	}
+}
@@ -0,0 +1,143 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestProcessConcurrent calls process from several goroutines at once,
+// as parallel walkers do, and checks the counts. Run it with -race.
+func TestProcessConcurrent(t *testing.T) {
+	root := t.TempDir()
+	const dirs, files = 8, 25
+	for d := range dirs {
+		dir := filepath.Join(root, fmt.Sprintf("d%d", d))
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for f := range files {
+			name := filepath.Join(dir, fmt.Sprintf("f%d", f))
+			// Every file has a duplicate in each other directory.
+			if err := os.WriteFile(name, []byte(fmt.Sprintf("contents %d\n", f)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// An extra name for the first file, which must only be counted
+		// as an existing link.
+		if err := os.Link(filepath.Join(dir, "f0"), filepath.Join(dir, "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := Config{Roots: []string{root}, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	ti := newTI()
+	ti.cfg = cfg
+	ti.ctx = context.Background()
+	ti.log = cfg.Logger
+
+	type entry struct {
+		path string
+		d    fs.DirEntry
+	}
+	var entries []entry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{path, d})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const walkers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, walkers)
+	for w := range walkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < len(entries); i += walkers {
+				if err := ti.process(entries[i].path, entries[i].d, nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if want := dirs * (files + 1); ti.FileCount != want {
+		t.Errorf("FileCount = %d, want %d", ti.FileCount, want)
+	}
+	if want := dirs * files; len(ti.Inodes) != want {
+		t.Errorf("len(Inodes) = %d, want %d", len(ti.Inodes), want)
+	}
+	if ti.ExistingLinks != dirs {
+		t.Errorf("ExistingLinks = %d, want %d", ti.ExistingLinks, dirs)
+	}
+	n := 0
+	for _, paths := range ti.SizeGroups {
+		n += len(paths)
+	}
+	if want := dirs * files; n != want {
+		t.Errorf("%d files in SizeGroups, want %d", n, want)
+	}
+}
+
+// BenchmarkWalk enumerates a tree of 10000 files, a tenth of them
+// symlinks, which are skipped without being stat'ed.
+func BenchmarkWalk(b *testing.B) {
+	root := b.TempDir()
+	const dirs, files = 40, 250
+	for d := range dirs {
+		dir := filepath.Join(root, fmt.Sprintf("d%d", d))
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		for f := range files {
+			name := filepath.Join(dir, fmt.Sprintf("f%d", f))
+			if f%10 == 9 {
+				if err := os.Symlink("f0", name); err != nil {
+					b.Fatal(err)
+				}
+				continue
+			}
+			if err := os.WriteFile(name, []byte(fmt.Sprint(f%20)), 0o644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	report := func(b *testing.B) {
+		b.ReportMetric(float64(dirs*files*b.N)/b.Elapsed().Seconds(), "files/s")
+	}
+	for _, walkers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("walkers=%d", walkers), func(b *testing.B) {
+			for range b.N {
+				ti := testTI(b, Config{Roots: []string{root}, Walkers: walkers})
+				if err := ti.walk(root); err != nil {
+					b.Fatal(err)
+				}
+				if want := dirs * files * 9 / 10; ti.FileCount != want {
+					b.Fatalf("FileCount = %d, want %d", ti.FileCount, want)
+				}
+			}
+			report(b)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Package atomicfile writes files so that readers never see them
+// partially written.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes data to a temporary file next to path, syncs it and
+// then renames it into place.
+func WriteFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpname)
+		return err
+	}
+	// Without this, a crash soon after the rename can leave an empty file.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpname)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if err := os.Chmod(tmpname, 0o644); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return os.Rename(tmpname, path)
+}
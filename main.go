@@ -3,33 +3,124 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/schollz/progressbar/v3"
-	"golang.org/x/crypto/blake2b"
+	"golang.org/x/term"
+	"pkg.i-no.de/pkg/d2hl/dedup"
 )
 
 const version = "v1.0.0"
 
+// Exit statuses, see the README.
+const (
+	exitOK      = 0
+	exitDupes   = 1
+	exitUsage   = 2 // Also used by the flag package.
+	exitPartial = 3
+	exitAborted = 4
+	exitWalk    = 5
+	exitFailed  = 6
+)
+
 var (
+	analyze    = flag.Bool("analyze", false, "Only report how much space duplicates take up, without linking or listing individual files")
+	listdevs   = flag.Bool("list-devices", false, "Only list the devices the files found are on, with how many files and bytes are on each")
+	listcands  = flag.Bool("list-candidates", false, "Only print the files that passed the filters and would be checksummed to stdout, one per line (see -print0)")
+	bench      = flag.Bool("bench", false, "Only checksum all files found with several numbers of jobs and print the throughput of each, to help pick -jobs; nothing is linked")
+	blockrep   = flag.Int64("blockreport", 0, "Only report how much space could be saved by sharing blocks of this many bytes, a power of two up to 64 MiB, between files, e.g. with reflinks, instead of whole files (0 means off); nothing is linked")
+	analyzetop = flag.Int("analyze-top", 10, "Number of groups wasting the most space to list with -analyze")
+	confirm    = flag.Bool("confirm", false, "Ask for confirmation on the terminal before modifying any files")
+	yes        = flag.Bool("yes", false, "With -confirm, assume yes instead of asking, e.g. when not running on a terminal")
 	dryrun     = flag.Bool("dryrun", false, "Do not do anything, just print what would be done")
-	jobs       = flag.Int("jobs", runtime.NumCPU(), "Number of parallel jobs to use when checksumming")
+	jobs       = flag.Int("jobs", runtime.NumCPU(), "Number of parallel jobs to use when checksumming and linking (0 means one per CPU)")
+	maxdepth   = depthFlag("maxdepth", "Only walk directories up to this many `levels` below the roots; 0 means only the files in the roots, and without it, there is no limit. With -follow-symlinks, symlinked directories count from the level of the symlink")
+	walkers    = flag.Int("walkers", 1, "Number of directories to read in parallel when enumerating files")
+	followsyms = flag.Bool("follow-symlinks", false, "Descend into symlinked directories and consider the targets of symlinked files")
 	nodotfiles = flag.Bool("nodot", false, "Exclude files starting with a dot")
+	skipvcs    = flag.Bool("skip-vcs", false, "Skip version control metadata directories (.git, .hg, .svn)")
+	warnspec   = flag.Bool("warn-special", false, "Warn about device files, sockets and named pipes found, for trees expected to hold only regular files")
+	include    = flag.String("include", "", "Comma-separated glob patterns; only consider files matching one of them")
+	exclude    = flag.String("exclude", "", "Comma-separated glob patterns of files and directories to skip; takes precedence over -include")
+	protect    = flag.String("excludefile", "", "File listing absolute paths or glob patterns, one per line, of files that must never be linked")
+	skipempty  = flag.Bool("skip-empty", true, "Skip empty files, since linking them saves no space")
+	linkempty  = flag.Bool("link-empty", false, "Link empty files too, like d2hl did before -skip-empty became the default")
 	minsize    = flag.Uint64("minsize", 0, "Minimum file size to consider")
+	maxsize    = flag.Uint64("maxsize", 0, "Only consider files smaller than this size (0 means no limit)")
+	hashalgo   = flag.String("hash", dedup.DefaultHash, "Checksum algorithm, one of "+strings.Join(dedup.Hashes, ", "))
+	hashbits   = flag.Int("hashbits", 0, "Output size in bits of the blake2b checksum, one of 256, 384, 512 (0 means 256)")
+	smallfile  = flag.Int64("smallfile", 0, "Compare files smaller than this many bytes by content instead of checksumming them (0 means off)")
+	readbuf    = flag.Int("readbuf", dedup.DefaultReadBuffer, "Read buffer size per checksum worker in bytes; up to a few MiB can help on fast storage")
+	mmap       = flag.Bool("mmap", false, "Memory-map large files to checksum them instead of reading them")
+	mmapmin    = flag.Int64("mmap-min", dedup.DefaultMmapMin, "Smallest file size in bytes to memory-map with -mmap")
+	trustmtime = flag.Bool("trust-mtime", false, "DANGEROUS: link files with the same size and mtime without checksumming them; only for trees known to be consistent, like rsync --link-dest backups (add -verify to compare contents before linking)")
+	maxread    = flag.Int64("maxread", 0, "Limit the combined read rate while checksumming to this many bytes per second (0 means no limit)")
+	failunread = flag.Bool("fail-on-unreadable", false, "Fail the run before linking anything if any candidate file cannot be read")
+	verify     = flag.Bool("verify", false, "Compare files byte-for-byte before linking them")
+	decompress = flag.Bool("decompress", false, "Checksum .gz and .zst files by their decompressed contents and log those that match; they are only linked if -verify finds them identical")
+	safe       = flag.Bool("safe", false, "Enable all safety checks at once: -verify and -require-same-perms, and refuse the symlink modes (see the README)")
+	mtimewarn  = flag.Bool("preserve-mtime", false, "Warn about linked files whose mtime differed from that of the link target (linking keeps only the target's timestamps)")
+	samemtime  = flag.Bool("require-same-mtime", false, "Do not link files whose mtime differs from that of the link target; this keeps timestamps stable at the cost of fewer dedupes")
+	reportfile = flag.String("report", "", "Write a JSON report of all (would-be) dedupe actions to this file")
+	compare    = flag.String("compare", "", "With -dryrun, log how the groups found differ from those in this earlier -report")
+	olderthan  = flag.String("older-than", "", "Skip files modified after this time, given in RFC 3339 format (e.g. 2024-01-31T00:00:00Z) or as a duration before now (e.g. 720h)")
+	skiprecent = flag.Duration("skip-recent", 0, "Skip files modified less than this long ago (e.g. 10m), as they may still be written to")
+	dump       = flag.String("dump", "", "Write every checksum and the files having it, one line per checksum sorted by checksum, to this file after checksumming")
+	manifest   = flag.String("manifest", "", "Write the checksums of all checksummed files to this file, for use with sha256sum -c, b2sum -c and the like")
+	csvfile    = flag.String("csv", "", "Write a CSV report of all (would-be) dedupe actions to this file, one row per linked file")
+	metrics    = flag.String("metrics-file", "", "Write run metrics to this file in Prometheus text format, e.g. for the node_exporter textfile collector")
+	minsavings = flag.Uint64("minsavings", 0, "Skip groups of duplicates that would free less than this many bytes in total")
+	maxfreed   = flag.Uint64("maxfreed", 0, "Stop linking once this many bytes have been freed, and only log the remaining duplicates (0 means no limit)")
+	mincount   = flag.Int("mincount", 0, "Skip groups of duplicates with fewer than this many files")
+	prefixlen  = flag.Int64("prefixbytes", 0, "If non-zero, checksum only this many leading bytes first and fully checksum only files that still match")
+	sameperms  = flag.Bool("require-same-perms", false, "Do not link groups whose members differ in owner, group or mode")
+	samedir    = flag.Bool("same-dir-only", false, "Only link duplicates that are in the same directory")
+	keep       = flag.String("keep", dedup.DefaultKeep, "Which file of a group the others are linked to, one of "+strings.Join(dedup.KeepPolicies, ", "))
+	prefer     = listFlag("prefer", "Path prefix of files to link the others in their group to, regardless of -keep; may be given more than once, earlier ones win")
+	specialok  = flag.Bool("allow-special-bits", false, "Also link files with the setuid, setgid or sticky bit set")
+	maxlinks   = flag.Uint64("maxlinks", 0, "Start a new link target once a file has this many links (0 means only when the filesystem refuses more)")
+	auditlog   = flag.String("auditlog", "", "Append a line of JSON to this file for each link as it is made")
+	checkpt    = flag.String("checkpoint", "", "Record finished groups in this file while linking, and skip them when restarting an interrupted run")
+	store      = flag.String("store", "", "Link all files of a group to <store>/<hash[:2]>/<hash> in this directory, adding it if needed; files without duplicates are checksummed and linked or added too")
+	usesymlink = flag.Bool("use-symlinks", false, "Replace files with relative symlinks where hard links are not possible, e.g. across devices; symlinks free the space just the same, but are not transparent to all programs")
+	symlinkdev = flag.String("symlink-across-devices", "", "Replace files on other devices with symlinks to identical copies on the device holding this directory")
+	syncdirs   = flag.Bool("sync", false, "Flush the directories of all replaced files to disk at the end, e.g. before taking a snapshot (costs a disk flush per directory)")
+	reflink    = flag.Bool("reflink", false, "Share data extents with FICLONE instead of hard-linking (btrfs, XFS and others)")
+	reflinkfb  = flag.Bool("reflink-fallback", false, "With -reflink, hard-link files if the filesystem cannot reflink them, instead of skipping them")
+	cachefile  = flag.String("cache", "", "Keep checksums in this file and reuse them for unchanged files, by i-node, so also under other roots or paths (e.g. bind mounts)")
+	recoverTmp = flag.Bool("recover", false, "Clean up temp files left behind by an interrupted run before starting")
+	topext     = flag.Int("topext", 10, "Number of file extensions to list in the breakdown of savings by extension (0 disables it)")
+	filelist   = flag.String("filelist", "", "Read the candidate files from this file, one per line, instead of walking directories (- for stdin)")
+	verifylnks = flag.String("verify-links", "", "Instead of looking for duplicates, check that the files in each line of this file (two paths separated by a tab) are links of each other, and link them if they are identical")
+	exportplan = flag.String("export-plan", "", "With -dryrun, write the groups that would be linked to this file, for review and -apply-plan")
+	applyplan  = flag.String("apply-plan", "", "Instead of looking for duplicates, link the groups in this file written by -export-plan, skipping files that have changed since")
+	fromstdin  = flag.Bool("from-stdin", false, "Read the candidate files from stdin, like -filelist -")
+	read0      = flag.Bool("read0", false, "With -filelist or -from-stdin, paths are terminated by NUL bytes instead of newlines")
+	print0     = flag.Bool("print0", false, "Print the paths of all (would-be) linked files to stdout, each followed by a NUL byte. With -list-candidates, separate the candidates with NUL bytes")
+	jsonsum    = flag.Bool("json-summary", false, "Print the run's totals as a JSON object to stdout at the end")
+	eventsaddr = flag.String("events-addr", "", "Send progress as newline-delimited JSON to this Unix socket path or TCP host:port")
+	timeout    = flag.Duration("timeout", 0, "Stop cleanly after this long (0 means no limit)")
+	progress   = flag.String("progress", "auto", "Show progress bars: auto (if stderr is a terminal and the log level is info or lower), always or never")
+	progressiv = flag.Duration("progress-interval", 5*time.Second, "How often to log progress instead of showing bars when stderr is not a terminal")
+	dbdir      = flag.String("dbdir", "", "Keep the checksum table in temp files in this directory instead of in memory, for very large trees; the list of paths is still kept in memory")
+	timings    = flag.Bool("timings", false, "Print the duration and throughput of each phase to stderr at the end, regardless of -level")
+	memstats   = flag.Bool("memstats", false, "Log heap usage and its peak at the end of each phase, and how many distinct checksums there are")
+	loghashes  = flag.Bool("log-hashes", false, "Log the checksum of each file at info level, without enabling all debug messages")
 	loglevel   = flag.String("level", "info", "Log level, one of debug, info, warn, error")
 	ver        = flag.Bool("version", false, "Show version and exit")
-	pathlist   []string
 )
 
 func main() {
@@ -38,21 +129,29 @@ func main() {
 		fmt.Fprintf(os.Stderr, "d2hl %s", version)
 		os.Exit(0)
 	}
+	if *safe {
+		if *usesymlink || *symlinkdev != "" {
+			// Symlinks replace files on other devices, which -safe
+			// promises to leave alone.
+			fmt.Fprintf(os.Stderr, "-safe cannot be combined with -use-symlinks or -symlink-across-devices\n")
+			os.Exit(exitUsage)
+		}
+		*verify = true
+		*sameperms = true
+	}
 	ll, err := strToLoglevel(*loglevel)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(-1)
+		os.Exit(exitUsage)
+	}
+	showbars, logprogress, err := showProgress(*progress, ll, *progressiv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(exitUsage)
 	}
-	logger := logSetup(os.Stderr, slog.LevelInfo, "20060102-15:04:05.000", true)
+	logger := logSetup(os.Stderr, ll, "20060102-15:04:05.000", true)
 
-	var root string
-	args := flag.Args()
-	if len(args) == 0 {
-		root = "."
-	} else {
-		root = args[0]
-	}
-	os.Exit(doD2hl(root, logger))
+	os.Exit(doD2hl(flag.Args(), showbars, logprogress, logger))
 }
 
 func strToLoglevel(s string) (slog.Level, error) {
@@ -70,200 +169,473 @@ func strToLoglevel(s string) (slog.Level, error) {
 	return l, fmt.Errorf("unknown log level '%s'", s)
 }
 
-func doD2hl(root string, logger *slog.Logger) int {
-	ti := newTI()
-	ti.log = logger
-	logger.Info("Enumerating files", "root", root)
-	start := time.Now()
-	err := filepath.Walk(root, ti.process)
+// showProgress decides from the -progress mode whether to show progress
+// bars, or to log progress every interval instead. In auto mode, progress
+// is only reported if info messages are logged, and bars, which would
+// fill log files with escape sequences, only on a terminal.
+func showProgress(mode string, ll slog.Level, interval time.Duration) (bool, time.Duration, error) {
+	if interval <= 0 {
+		return false, 0, fmt.Errorf("invalid progress interval %v", interval)
+	}
+	switch mode {
+	case "always":
+		return true, 0, nil
+	case "never":
+		return false, 0, nil
+	case "auto":
+		if ll > slog.LevelInfo {
+			return false, 0, nil
+		}
+		if !term.IsTerminal(int(os.Stderr.Fd())) {
+			return false, interval, nil
+		}
+		return true, 0, nil
+	}
+	return false, 0, fmt.Errorf("unknown progress mode '%s'", mode)
+}
+
+// parseCutoff parses the -older-than value s, which is either a time in
+// RFC 3339 format, or a duration before now.
+func parseCutoff(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
 	if err != nil {
-		logger.Error("Walking tree failed", "error", err)
-		return -1
+		return time.Time{}, fmt.Errorf("neither an RFC 3339 time nor a duration: %q", s)
 	}
-	elapsed := time.Since(start)
-	logger.Info("Files enumerated", "total", ti.FileCount, "tocheck", len(pathlist),
-		"time", elapsed, "per_sec", float64(ti.FileCount)/elapsed.Seconds())
+	return now.Add(-d), nil
+}
 
-	//nolint:staticcheck // We do not use contexts at all
-	if logger.Enabled(nil, slog.LevelInfo) {
-		ti.progbar = progressbar.Default(int64(len(pathlist)), "Checksum")
+// benchJobs returns the numbers of jobs to try with -bench: powers of two
+// up to twice the number of CPUs, and the number of CPUs itself.
+func benchJobs(bench bool) []int {
+	if !bench {
+		return nil
+	}
+	var jobs []int
+	for n := 1; n <= 2*runtime.NumCPU(); n *= 2 {
+		if n > runtime.NumCPU() && jobs[len(jobs)-1] < runtime.NumCPU() {
+			jobs = append(jobs, runtime.NumCPU())
+		}
+		jobs = append(jobs, n)
 	}
+	return jobs
+}
+
+// stringList is a flag.Value collecting the values of a flag given more
+// than once.
+type stringList []string
 
-	start = time.Now()
-	c := make(chan string)
-	var wg sync.WaitGroup
-	for i := 0; i < *jobs; i++ {
-		go ti.checksum(i, c, &wg)
-		wg.Add(1)
-	}
-	for _, path := range pathlist {
-		c <- path
-	}
-	close(c)
-	wg.Wait()
-	elapsed = time.Since(start)
-	logger.Info("Files checksummed", "total", len(pathlist), "time", elapsed,
-		"per_sec", float64(len(pathlist))/elapsed.Seconds())
-	start = time.Now()
-	s := dedupe(&ti)
-	elapsed = time.Since(start)
-	logger.Info("Deduplication complete", "freedspace", humanize.Bytes(s),
-		"dedupes", ti.DupeCount, "time", elapsed, "per_sec", float64(ti.DupeCount)/elapsed.Seconds())
-	return 0
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-type treeinfo struct {
-	RWLock    *sync.RWMutex
-	Sums      map[string][]string
-	Inodes    map[uint64]bool
-	DupeCount int
-	FileCount int
-	progbar   *progressbar.ProgressBar
-	log       *slog.Logger
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
 
-func newTI() treeinfo {
-	var ti treeinfo
-	var newmtx sync.RWMutex
-	ti.Sums = make(map[string][]string)
-	ti.Inodes = make(map[uint64]bool)
-	ti.RWLock = &newmtx
-	return ti
+// listFlag defines a flag that may be given more than once, and returns
+// its values in the order given.
+func listFlag(name, usage string) *[]string {
+	var l stringList
+	flag.Var(&l, name, usage)
+	return (*[]string)(&l)
 }
 
-func (ti *treeinfo) process(path string, info os.FileInfo, err error) error {
+// depthValue is the flag.Value of -maxdepth, which is unset by default
+// and must not be negative.
+type depthValue struct {
+	set bool
+	n   int
+}
+
+func (d *depthValue) String() string {
+	if d == nil || !d.set {
+		return ""
+	}
+	return strconv.Itoa(d.n)
+}
+
+func (d *depthValue) Set(v string) error {
+	n, err := strconv.Atoi(v)
 	if err != nil {
 		return err
 	}
-	if !info.Mode().IsRegular() {
-		return nil
+	if n < 0 {
+		return fmt.Errorf("must not be negative: %d", n)
 	}
-	if *nodotfiles && strings.HasPrefix(info.Name(), ".") {
-		return nil
+	d.set, d.n = true, n
+	return nil
+}
+
+// depth returns the value for dedup.Config.MaxDepth, which counts the
+// roots as the first level, or zero if the flag was not given.
+func (d *depthValue) depth() int {
+	if !d.set {
+		return 0
 	}
-	sz := info.Size()
-	if sz < 0 {
-		ti.log.Error("Found file with negative size, please investigate", "path", path, "size", info.Size())
-		os.Exit(-1)
+	return d.n + 1
+}
+
+// depthFlag defines a flag like -maxdepth.
+func depthFlag(name, usage string) *depthValue {
+	var d depthValue
+	flag.Var(&d, name, usage)
+	return &d
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var r []string
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			r = append(r, item)
+		}
 	}
-	if uint64(sz) < *minsize {
-		return nil
+	return r
+}
+
+// askConfirm asks on the terminal whether to go ahead with linking.
+func askConfirm(files int, bytes uint64) bool {
+	fmt.Fprintf(os.Stderr, "About to link %d files, freeing up to %s. Proceed? [y/N] ", files, humanize.Bytes(bytes))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
 	}
-	if strings.HasSuffix(path, ".tmpdedupe") {
-		ti.log.Error("Leftover file from previous run, please investigate", "path", path)
-		os.Exit(-1)
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// readList reads a file with one entry per line, ignoring empty lines
+// and lines starting with "#".
+func readList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	ti.FileCount++
-	stat, ok := info.Sys().(*syscall.Stat_t)
-	if !ok {
-		ti.log.Error("We somehow got a file without an inode number", "path", path)
-		os.Exit(-1)
+	var r []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r = append(r, line)
 	}
+	return r, nil
+}
 
-	if ok = ti.Inodes[stat.Ino]; ok {
-		ti.log.Debug("We have already seen this i-node, skipping the file", "inodenum", stat.Ino)
-		return nil
+// readPaths reads a list of paths terminated by delim from the file at
+// path or from stdin if path is "-". Since paths may contain spaces, they
+// are taken as they are, only empty ones are dropped.
+func readPaths(path string, delim byte) ([]string, error) {
+	r := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
 	}
-	ti.Inodes[stat.Ino] = true
-	pathlist = append(pathlist, path)
-	return nil
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, p := range strings.Split(string(data), string(delim)) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
 }
 
-func (ti treeinfo) String() string {
-	r := make([]string, 0, len(ti.Sums))
-	for sum, paths := range ti.Sums {
-		r = append(r, fmt.Sprintf("%s: %s", sum, strings.Join(paths, " ")))
+// readPairs reads the pairs of paths for -verify-links from the file at
+// path, one pair per line, separated by a tab. Empty lines are skipped.
+func readPairs(path string) ([][2]string, error) {
+	lines, err := readPaths(path, '\n')
+	if err != nil {
+		return nil, err
 	}
-	return strings.Join(r, "\n")
+	pairs := [][2]string{}
+	for i, line := range lines {
+		a, b, ok := strings.Cut(strings.TrimSuffix(line, "\r"), "\t")
+		if !ok || a == "" || b == "" || strings.Contains(b, "\t") {
+			return nil, fmt.Errorf("entry %d is not two paths separated by a tab: %q", i+1, line)
+		}
+		pairs = append(pairs, [2]string{a, b})
+	}
+	return pairs, nil
 }
 
-func (ti *treeinfo) checksum(id int, p chan string, wg *sync.WaitGroup) {
-	wlog := ti.log.With("workerid", id)
-	wlog.Debug("Worker starting")
-	defer wg.Done()
-	for path := range p {
-		f, err := os.Open(path)
+func doD2hl(roots []string, showbars bool, logprogress time.Duration, logger *slog.Logger) int {
+	sigctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// Restore the default handlers, so a second signal kills us outright.
+		<-sigctx.Done()
+		stop()
+	}()
+	ctx := sigctx
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(sigctx, *timeout)
+		defer cancel()
+	}
+	var protected []string
+	if *protect != "" {
+		var err error
+		protected, err = readList(*protect)
 		if err != nil {
-			wlog.Warn("Could not open file", "path", path, "err", err)
-			continue
+			logger.Error("Could not read exclude file", "path", *protect, "error", err)
+			return exitFailed
 		}
-
-		h, err := blake2b.New256(nil)
+	}
+	if (*print0 || *listcands || *bench) && *jsonsum {
+		logger.Error("-print0, -list-candidates and -bench print to stdout, as does -json-summary, use only one of them")
+		return exitUsage
+	}
+	var files []string
+	if *fromstdin {
+		*filelist = "-"
+	}
+	if *filelist != "" {
+		if len(roots) > 0 {
+			logger.Error("Cannot walk directories and read a file list at the same time")
+			return exitUsage
+		}
+		var err error
+		delim := byte('\n')
+		if *read0 {
+			delim = 0
+		}
+		files, err = readPaths(*filelist, delim)
 		if err != nil {
-			wlog.Error("Could not create new hash", "err", err)
-			panic("Exiting")
+			logger.Error("Could not read file list", "path", *filelist, "error", err)
+			return exitFailed
 		}
-		if _, err := io.Copy(h, f); err != nil {
-			f.Close()
-			continue
+	}
+	var pairs [][2]string
+	if *verifylnks != "" {
+		if len(roots) > 0 || *filelist != "" {
+			logger.Error("Cannot check links and look for duplicates at the same time")
+			return exitUsage
 		}
-		f.Close()
-		s := fmt.Sprintf("%x", h.Sum(nil))
-		wlog.Debug("Checksum", "path", path, "sum", s)
-		ti.RWLock.Lock()
-		ti.Sums[s] = append(ti.Sums[s], path)
-		ti.RWLock.Unlock()
-		if ti.progbar != nil {
-			err = ti.progbar.Add(1)
-			if err != nil {
-				panic(err)
-			}
+		var err error
+		pairs, err = readPairs(*verifylnks)
+		if err != nil {
+			logger.Error("Could not read links to check", "path", *verifylnks, "error", err)
+			return exitFailed
 		}
 	}
-	wlog.Debug("Worker exiting")
-}
-
-func dedupe(ti *treeinfo) uint64 {
-	var savings uint64
-
-	//nolint:staticcheck // We do not use contexts at all
-	if ti.log.Enabled(nil, slog.LevelInfo) {
-		ti.progbar = progressbar.Default(int64(len(pathlist)), "Cmp/Link")
-	}
-	for _, names := range ti.Sums {
-		if ti.progbar != nil {
-			err := ti.progbar.Add(1)
-			if err != nil {
-				panic(err)
-			}
+	if *applyplan != "" && (len(roots) > 0 || *filelist != "" || *verifylnks != "") {
+		logger.Error("Cannot apply a plan and look for duplicates or check links at the same time")
+		return exitUsage
+	}
+	var cutoff time.Time
+	if *olderthan != "" {
+		var err error
+		cutoff, err = parseCutoff(*olderthan, time.Now())
+		if err != nil {
+			logger.Error("Invalid -older-than", "error", err)
+			return exitUsage
 		}
-		if len(names) <= 1 {
-			continue
+	}
+	var oldreport []dedup.Group
+	if *compare != "" {
+		if !*dryrun {
+			logger.Error("-compare only works with -dryrun")
+			return exitUsage
 		}
-		first := names[0]
-		fi, err := os.Stat(first)
+		var err error
+		oldreport, err = readReport(*compare)
 		if err != nil {
-			ti.log.Error("Could not stat destination file for dedupe", "path", first, "error", err)
-			os.Exit(-1)
+			logger.Error("Could not read report to compare with", "path", *compare, "error", err)
+			return exitFailed
 		}
-		size := fi.Size()
-		for _, name := range names[1:] {
-			if *dryrun {
-				ti.log.Info("Would deduplicate", "src", name, "dest", first, "size", size)
-			} else {
-				ti.log.Info("Deduping", "src", name, "dest", first, "size", size)
-				tmpname := fmt.Sprintf("%s.tmpdedupe", name)
-				err := os.Rename(name, tmpname)
-				if err != nil {
-					ti.log.Error("Could not rename source file for dedupe", "path", name, "tmpname", tmpname, "error", err)
-					os.Exit(-1)
-				}
-				err = os.Link(first, name)
-				if err != nil {
-					ti.log.Error("Could not link src file to dest file", "src", name, "dest", first, "error", err)
-					os.Exit(-1)
-				}
-				err = os.Remove(tmpname)
-				if err != nil {
-					ti.log.Error("Could not delete temp file", "tmpname", tmpname, "error", err)
-					os.Exit(-1)
-				}
+	}
+	var confirmfunc func(int, uint64) bool
+	if *confirm && !*yes {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			logger.Error("Cannot ask for confirmation, stdin is not a terminal; pass -yes to confirm non-interactively")
+			return exitUsage
+		}
+		confirmfunc = askConfirm
+	}
+	res, err := dedup.Run(ctx, dedup.Config{
+		Roots:            roots,
+		Files:            files,
+		LinkPairs:        pairs,
+		ExportPlan:       *exportplan,
+		ApplyPlan:        *applyplan,
+		Jobs:             *jobs,
+		Walkers:          *walkers,
+		MaxDepth:         maxdepth.depth(),
+		FollowSymlinks:   *followsyms,
+		Analyze:          *analyze,
+		AnalyzeTop:       *analyzetop,
+		ListDevices:      *listdevs,
+		ListCandidates:   *listcands,
+		Bench:            benchJobs(*bench),
+		BlockReport:      *blockrep,
+		Confirm:          confirmfunc,
+		DryRun:           *dryrun,
+		NoDotFiles:       *nodotfiles,
+		SkipVCS:          *skipvcs,
+		WarnSpecial:      *warnspec,
+		Include:          splitList(*include),
+		Exclude:          splitList(*exclude),
+		Protect:          protected,
+		LinkEmpty:        *linkempty || !*skipempty,
+		MinSize:          *minsize,
+		MaxSize:          *maxsize,
+		SkipRecent:       *skiprecent,
+		OlderThan:        cutoff,
+		MinSavings:       *minsavings,
+		MinCount:         *mincount,
+		MaxFreed:         *maxfreed,
+		PrefixBytes:      *prefixlen,
+		Hash:             *hashalgo,
+		HashBits:         *hashbits,
+		SmallFile:        *smallfile,
+		ReadBuffer:       *readbuf,
+		Mmap:             *mmap,
+		MmapMin:          *mmapmin,
+		TrustMtime:       *trustmtime,
+		MaxRead:          *maxread,
+		FailOnUnreadable: *failunread,
+		Verify:           *verify,
+		Decompress:       *decompress,
+		WarnMtime:        *mtimewarn,
+		RequireSameMtime: *samemtime,
+		RequireSamePerms: *sameperms,
+		SameDirOnly:      *samedir,
+		Keep:             *keep,
+		Prefer:           *prefer,
+		AllowSpecialBits: *specialok,
+		MaxLinks:         *maxlinks,
+		Checkpoint:       *checkpt,
+		AuditLog:         *auditlog,
+		Store:            *store,
+		SymlinkDevice:    *symlinkdev,
+		UseSymlinks:      *usesymlink,
+		Sync:             *syncdirs,
+		Reflink:          *reflink,
+		ReflinkFallback:  *reflinkfb,
+		CacheFile:        *cachefile,
+		Recover:          *recoverTmp,
+		TopExtensions:    *topext,
+		EventsAddr:       *eventsaddr,
+		Progress:         showbars,
+		LogProgress:      logprogress,
+		DBDir:            *dbdir,
+		Manifest:         *manifest,
+		Dump:             *dump,
+		LogHashes:        *loghashes,
+		MemStats:         *memstats,
+		Logger:           logger,
+	})
+	if *timings {
+		// Phases that completed are worth seeing even if a later one failed.
+		if err := writeTimings(os.Stderr, res); err != nil {
+			logger.Error("Could not print timings", "error", err)
+		}
+	}
+	if errors.Is(err, dedup.ErrAborted) {
+		logger.Info("Aborted, no files were changed")
+		return exitAborted
+	}
+	status := exitOK
+	if *dryrun && res.DupeCount > 0 {
+		status = exitDupes
+	}
+	// Runs stopped early still report what they have done so far.
+	stopped := false
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Warn("Timeout reached, stopped early", "timeout", *timeout, "freedspace", humanize.Bytes(res.FreedBytes),
+			"dedupes", res.DupeCount)
+		stopped = true
+	case errors.Is(err, context.Canceled):
+		logger.Warn("Interrupted, stopped early", "error", err, "freedspace", humanize.Bytes(res.FreedBytes),
+			"dedupes", res.DupeCount)
+		stopped = true
+	}
+	if stopped {
+		status = exitPartial
+		err = nil
+	}
+	if err != nil {
+		logger.Error("Run failed", "error", err, "freedspace", humanize.Bytes(res.FreedBytes), "dedupes", res.DupeCount)
+		switch {
+		case errors.Is(err, dedup.ErrConfig):
+			return exitUsage
+		case errors.Is(err, dedup.ErrWalk):
+			return exitWalk
+		}
+		return exitFailed
+	}
+	if *bench {
+		if err := writeBench(os.Stdout, res.Bench); err != nil {
+			logger.Error("Could not print benchmark results", "error", err)
+			return exitFailed
+		}
+		return status
+	}
+	if *listcands {
+		delim := byte('\n')
+		if *print0 {
+			delim = 0
+		}
+		for _, p := range res.Candidates {
+			if _, err := io.WriteString(os.Stdout, p+string(delim)); err != nil {
+				logger.Error("Could not print candidate files", "error", err)
+				return exitFailed
 			}
-			//nolint:gosec // We _really_ don't expect negative filesizes here,
-			// since we already check in the checksumming phase
-			savings += uint64(size)
-			ti.DupeCount++
+		}
+		return status
+	}
+	// Unless it got to linking, a run stopped early has nothing to report,
+	// and must not replace the reports of an earlier run with empty ones.
+	reports := !stopped || len(res.Groups) > 0
+	if !reports && (*reportfile != "" || *csvfile != "" || *compare != "") {
+		logger.Warn("Stopped before any group was linked, not writing or comparing reports")
+	}
+	if *compare != "" && reports {
+		compareReports(logger, oldreport, res.Groups)
+	}
+	if *print0 {
+		// First, so the linked files are listed even if a report fails.
+		if err := writePaths(os.Stdout, res.Groups, 0); err != nil {
+			logger.Error("Could not print linked files", "error", err)
+			return exitFailed
+		}
+	}
+	if *reportfile != "" && reports {
+		if err := writeReport(*reportfile, res.Groups); err != nil {
+			logger.Error("Could not write report", "path", *reportfile, "error", err)
+			return exitFailed
+		}
+	}
+	if *csvfile != "" && reports {
+		if err := writeCSV(*csvfile, res.Groups); err != nil {
+			logger.Error("Could not write CSV report", "path", *csvfile, "error", err)
+			return exitFailed
+		}
+	}
+	if *metrics != "" {
+		if err := writeMetrics(*metrics, res, *dryrun, time.Now()); err != nil {
+			logger.Error("Could not write metrics", "path", *metrics, "error", err)
+			return exitFailed
+		}
+	}
+	if *jsonsum {
+		if err := writeSummary(os.Stdout, res, *dryrun); err != nil {
+			logger.Error("Could not print summary", "error", err)
+			return exitFailed
 		}
 	}
-	return savings
+	return status
 }
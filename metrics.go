@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"time"
+
+	"pkg.i-no.de/pkg/d2hl/dedup"
+	"pkg.i-no.de/pkg/d2hl/internal/atomicfile"
+)
+
+// writeMetrics writes the summary of res, a dry run if dryrun is set, to
+// path in the Prometheus text exposition format.
+func writeMetrics(path string, res dedup.Result, dryrun bool, now time.Time) error {
+	var b bytes.Buffer
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("d2hl_freed_bytes", "gauge", "Bytes freed (or that would be freed) by the last run.", res.FreedBytes)
+	metric("d2hl_dupes_total", "gauge", "Files linked (or that would be linked) by the last run.", res.DupeCount)
+	metric("d2hl_files_total", "gauge", "Files found by the last run.", res.FileCount)
+	metric("d2hl_candidates_total", "gauge", "Files that passed the filters in the last run.", res.CheckedCount)
+	metric("d2hl_files_checked", "gauge", "Files checksummed by the last run.", res.HashedCount)
+	fmt.Fprintf(&b, "# HELP d2hl_run_seconds Wall time spent in each phase of the last run.\n# TYPE d2hl_run_seconds gauge\n")
+	phases := make([]string, 0, len(res.Durations))
+	for phase := range res.Durations {
+		phases = append(phases, phase)
+	}
+	slices.Sort(phases)
+	for _, phase := range phases {
+		fmt.Fprintf(&b, "d2hl_run_seconds{phase=%q} %g\n", phase, res.Durations[phase].Seconds())
+	}
+	dry := 0
+	if dryrun {
+		dry = 1
+	}
+	metric("d2hl_dry_run", "gauge", "Whether the last run was a dry run.", dry)
+	metric("d2hl_last_run_timestamp_seconds", "gauge", "Unix time at which the last run finished.", now.Unix())
+	return atomicfile.WriteFile(path, b.Bytes())
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"pkg.i-no.de/pkg/d2hl/dedup"
+	"pkg.i-no.de/pkg/d2hl/internal/atomicfile"
+)
+
+// sortGroups sorts groups by hash and their members by path, so reports
+// of different runs can be diffed.
+func sortGroups(groups []dedup.Group) {
+	slices.SortFunc(groups, func(a, b dedup.Group) int {
+		return strings.Compare(a.Hash, b.Hash)
+	})
+	for _, g := range groups {
+		slices.Sort(g.Linked)
+	}
+}
+
+// reportGroup is the JSON form of a dedup.Group in reports. JSON strings
+// cannot hold paths that are not valid UTF-8, so those are also written
+// base64-encoded: the target as target_b64, and the linked files in
+// linked_b64, which then has an entry for each of them, null for those
+// that are valid.
+type reportGroup struct {
+	dedup.Group
+	RawTarget []byte   `json:"target_b64,omitempty"`
+	RawLinked [][]byte `json:"linked_b64,omitempty"`
+}
+
+// newReportGroup returns the JSON form of g.
+func newReportGroup(g dedup.Group) reportGroup {
+	rg := reportGroup{Group: g}
+	if !utf8.ValidString(g.Target) {
+		rg.RawTarget = []byte(g.Target)
+	}
+	for i, p := range g.Linked {
+		if utf8.ValidString(p) {
+			continue
+		}
+		if rg.RawLinked == nil {
+			rg.RawLinked = make([][]byte, len(g.Linked))
+		}
+		rg.RawLinked[i] = []byte(p)
+	}
+	return rg
+}
+
+// group returns the dedup.Group rg is the JSON form of.
+func (rg reportGroup) group() dedup.Group {
+	g := rg.Group
+	if rg.RawTarget != nil {
+		g.Target = string(rg.RawTarget)
+	}
+	for i, raw := range rg.RawLinked {
+		if raw != nil && i < len(g.Linked) {
+			g.Linked[i] = string(raw)
+		}
+	}
+	return g
+}
+
+// writeReport writes groups as a JSON array to path.
+func writeReport(path string, groups []dedup.Group) error {
+	sortGroups(groups)
+	// An empty array, rather than null, when nothing was linked.
+	rgs := make([]reportGroup, 0, len(groups))
+	for _, g := range groups {
+		rgs = append(rgs, newReportGroup(g))
+	}
+	data, err := json.MarshalIndent(rgs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(data, '\n'))
+}
+
+// writeCSV writes groups to path as CSV, with one row per linked file.
+// The group's columns are repeated on each row, and count includes the
+// target.
+func writeCSV(path string, groups []dedup.Group) error {
+	sortGroups(groups)
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write([]string{"hash", "size", "count", "bytes_saved", "target", "member_path"}); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		for _, member := range g.Linked {
+			err := w.Write([]string{
+				g.Hash,
+				strconv.FormatInt(g.Size, 10),
+				strconv.Itoa(len(g.Linked) + 1),
+				strconv.FormatUint(g.Savings, 10),
+				g.Target,
+				member,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b.Bytes())
+}
+
+// writePaths writes the paths of all linked files in groups to w, each
+// followed by delim.
+func writePaths(w io.Writer, groups []dedup.Group, delim byte) error {
+	sortGroups(groups)
+	for _, g := range groups {
+		for _, member := range g.Linked {
+			if _, err := io.WriteString(w, member+string(delim)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeBench writes the results of -bench to w as a table.
+func writeBench(w io.Writer, results []dedup.BenchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "jobs\tfiles\tbytes\tseconds\tMB/s\t\n")
+	for _, r := range results {
+		mbps := 0.0
+		if r.Duration > 0 {
+			mbps = float64(r.Bytes) / 1e6 / r.Duration.Seconds()
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%.2f\t%.1f\t\n", r.Jobs, r.Files, r.Bytes, r.Duration.Seconds(), mbps)
+	}
+	return tw.Flush()
+}
+
+// writeTimings writes the duration and throughput of each phase of res
+// to w as a table.
+func writeTimings(w io.Writer, res dedup.Result) error {
+	phases := []struct {
+		name  string
+		items int
+		bytes int64
+	}{
+		{"enumerate", res.FileCount, 0},
+		{"prefix", res.CheckedCount, 0},
+		{"checksum", res.HashedCount, res.BytesRead},
+		{"dedupe", res.DupeCount, 0},
+	}
+	if len(res.Durations) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "phase\ttime\titems\titems/s\tMB/s\t\n")
+	for _, p := range phases {
+		d, ok := res.Durations[p.name]
+		if !ok {
+			continue
+		}
+		var rate, mbps float64
+		if d > 0 {
+			rate = float64(p.items) / d.Seconds()
+			mbps = float64(p.bytes) / 1e6 / d.Seconds()
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%d\t%.1f\t%.1f\t\n", p.name, d, p.items, rate, mbps)
+	}
+	return tw.Flush()
+}
+
+// summary holds the totals of a run, as printed by -json-summary.
+type summary struct {
+	DryRun     bool               `json:"dry_run"`
+	Files      int                `json:"files"`
+	Checked    int                `json:"checked"`
+	Dupes      int                `json:"dupes"`
+	FreedBytes uint64             `json:"freed_bytes"`
+	Seconds    map[string]float64 `json:"seconds"`
+}
+
+// writeSummary writes the totals of res to w as a JSON object.
+func writeSummary(w io.Writer, res dedup.Result, dryrun bool) error {
+	s := summary{
+		DryRun:     dryrun,
+		Files:      res.FileCount,
+		Checked:    res.CheckedCount,
+		Dupes:      res.DupeCount,
+		FreedBytes: res.FreedBytes,
+		Seconds:    make(map[string]float64),
+	}
+	for phase, d := range res.Durations {
+		s.Seconds[phase] = d.Seconds()
+	}
+	return json.NewEncoder(w).Encode(s)
+}